@@ -0,0 +1,236 @@
+package run
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Cgroup places a [Process] in a dedicated cgroup v2 created for each run, applying limits to the
+// process and all of its descendants and accounting for their resource usage.
+//
+// The cgroup hierarchy must be delegated to and writable by this program. If it isn't, the process runs
+// outside of a cgroup unless Required is set.
+//
+// A Cgroup may be shared between runs, [Cgroup.Usage] reports the usage of the most recent run to exit.
+type Cgroup struct {
+	// cgroup directory to create the process's cgroup in. Defaults to the cgroup of this program.
+	//
+	// Limits can only be applied if Parent contains no processes of its own, see "no internal process
+	// constraint" in cgroups(7).
+	Parent string
+	// memory.max in bytes. 0 is unlimited.
+	MemoryMax int64
+	// cpu.max expressed as a number of CPUs, 1.5 allows one and a half CPUs worth of time. 0 is unlimited.
+	CPUMax float64
+	// pids.max. 0 is unlimited.
+	PidsMax int64
+	// fail to run the process instead of falling back to running without a cgroup.
+	Required bool
+
+	mu    sync.Mutex
+	usage CgroupUsage
+	err   error
+}
+
+// CgroupUsage is the resource usage accounted by a [Cgroup].
+type CgroupUsage struct {
+	// total, user and system CPU time from cpu.stat.
+	CPU    time.Duration
+	User   time.Duration
+	System time.Duration
+	// peak memory usage in bytes from memory.peak, 0 if the memory controller is not enabled.
+	MemoryPeak uint64
+	// number of times a process was killed for exceeding memory.max.
+	OOMKills int
+}
+
+// Usage returns the resource usage of the most recent run placed in c.
+//
+// err is non-nil if that run fell back to not using a cgroup, or usage could not be read.
+func (c *Cgroup) Usage() (CgroupUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usage, c.err
+}
+
+func (c *Cgroup) record(usage CgroupUsage, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage, c.err = usage, err
+}
+
+// cgroupCPUPeriod is the period used for cpu.max.
+const cgroupCPUPeriod = 100 * time.Millisecond
+
+var unsafeCgroupChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// cgroup is a cgroup created for a single run of a [Process].
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// create creates a cgroup for a process named name, applying the limits of c.
+func (c *Cgroup) create(name string) (*cgroup, error) {
+	parent := c.Parent
+	if parent == "" {
+		var err error
+		if parent, err = ownCgroup(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("not a cgroup v2 directory: %w", err)
+	}
+
+	var controllers []string
+	if c.MemoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if c.CPUMax > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if c.PidsMax > 0 {
+		controllers = append(controllers, "+pids")
+	}
+	if len(controllers) > 0 {
+		subtree := filepath.Join(parent, "cgroup.subtree_control")
+		if err := os.WriteFile(subtree, []byte(strings.Join(controllers, " ")), 0); err != nil {
+			return nil, fmt.Errorf("enabling controllers: %w", err)
+		}
+	}
+
+	name = unsafeCgroupChars.ReplaceAllString(name, "_")
+	path, err := os.MkdirTemp(parent, fmt.Sprintf("run-%s-%d-", name, os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: path}
+
+	limits := map[string]string{}
+	if c.MemoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(c.MemoryMax, 10)
+	}
+	if c.CPUMax > 0 {
+		quota := time.Duration(c.CPUMax * float64(cgroupCPUPeriod))
+		limits["cpu.max"] = fmt.Sprintf("%d %d", quota.Microseconds(), cgroupCPUPeriod.Microseconds())
+	}
+	if c.PidsMax > 0 {
+		limits["pids.max"] = strconv.FormatInt(c.PidsMax, 10)
+	}
+	for file, limit := range limits {
+		if err := cg.write(file, limit); err != nil {
+			return nil, errors.Join(err, cg.remove())
+		}
+	}
+
+	if cg.dir, err = os.Open(path); err != nil {
+		return nil, errors.Join(err, cg.remove())
+	}
+	return cg, nil
+}
+
+// ownCgroup returns the cgroup v2 directory this program is in.
+func ownCgroup() (string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var rel string
+	var found bool
+	for line := range strings.Lines(string(b)) {
+		if rel, found = strings.CutPrefix(strings.TrimSpace(line), "0::"); found {
+			break
+		}
+	}
+	if !found {
+		return "", errors.New("not in a cgroup v2 hierarchy")
+	}
+
+	mounts, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	for line := range strings.Lines(string(mounts)) {
+		// device mountpoint fstype options ...
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return filepath.Join(fields[1], rel), nil
+		}
+	}
+	return "", errors.New("cgroup2 filesystem not mounted")
+}
+
+func (cg *cgroup) write(file, value string) error {
+	return os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0)
+}
+
+// kill kills every process in cg.
+func (cg *cgroup) kill() error {
+	if err := cg.write("cgroup.kill", "1"); err == nil {
+		return nil
+	}
+	// cgroup.kill is only available from Linux 5.14
+	procs, err := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for pid := range strings.FieldsSeq(string(procs)) {
+		if pid, err := strconv.Atoi(pid); err == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// usage reads the resource usage accounted so far.
+func (cg *cgroup) usage() (CgroupUsage, error) {
+	var u CgroupUsage
+	stat, err := cg.readKeyed("cpu.stat")
+	if err != nil {
+		return u, err
+	}
+	u.CPU = time.Duration(stat["usage_usec"]) * time.Microsecond
+	u.User = time.Duration(stat["user_usec"]) * time.Microsecond
+	u.System = time.Duration(stat["system_usec"]) * time.Microsecond
+
+	// memory accounting is only available with the memory controller enabled
+	if peak, err := os.ReadFile(filepath.Join(cg.path, "memory.peak")); err == nil {
+		u.MemoryPeak, _ = strconv.ParseUint(string(bytes.TrimSpace(peak)), 10, 64)
+	}
+	if events, err := cg.readKeyed("memory.events"); err == nil {
+		u.OOMKills = int(events["oom_kill"])
+	}
+	return u, nil
+}
+
+// readKeyed reads a flat keyed file such as cpu.stat.
+func (cg *cgroup) readKeyed(file string) (map[string]uint64, error) {
+	return readKeyedFile(filepath.Join(cg.path, file), ' ')
+}
+
+// remove kills any remaining processes in cg and removes it.
+func (cg *cgroup) remove() error {
+	if cg.dir != nil {
+		_ = cg.dir.Close()
+	}
+	_ = cg.kill()
+	// killed processes leave the cgroup asynchronously
+	var err error
+	for range 100 {
+		if err = os.Remove(cg.path); !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(treePollInterval)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+package run
+
+import "syscall"
+
+// place makes a process started with attr start inside cg.
+func (cg *cgroup) place(attr *syscall.SysProcAttr) error {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package run
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (cg *cgroup) place(_ *syscall.SysProcAttr) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,220 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Environ returns the environment p runs with as a sorted list of "key=value" pairs.
+//
+// The environment is built up in layers, each taking priority over the last:
+//
+//  1. Variables inherited from this program, filtered by InheritOnly and DoNotInherit.
+//  2. Variables loaded from each of EnvFiles in order.
+//  3. Env.
+//
+// Variables are inherited if InheritOSEnv is true, InheritOnly or DoNotInherit is set, or neither Env nor
+// EnvFiles is set so a Process that doesn't configure its environment inherits it like [exec.Cmd].
+//
+// References to other variables written as ${VAR} or $VAR in EnvFiles and Env are expanded against the
+// layers below, and for EnvFiles, the variables defined earlier in the same file. Undefined variables
+// expand to the empty string. A literal $ is written $$ in Env.
+func (p Process) Environ() ([]string, error) {
+	env := map[string]string{}
+
+	inherit := p.InheritOSEnv || len(p.InheritOnly) > 0 || len(p.DoNotInherit) > 0 ||
+		(len(p.Env) == 0 && len(p.EnvFiles) == 0)
+	if inherit {
+		for _, kv := range os.Environ() {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			inherit, err := p.inherits(k)
+			if err != nil {
+				return nil, err
+			}
+			if inherit {
+				env[k] = v
+			}
+		}
+	}
+
+	lookup := func(k string) string { return env[k] }
+	for _, fn := range p.EnvFiles {
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("run: env file: %w", err)
+		}
+		vars, err := parseDotenv(string(b), lookup)
+		if err != nil {
+			return nil, fmt.Errorf("run: env file %s: %w", fn, err)
+		}
+		for _, kv := range vars {
+			env[kv[0]] = kv[1]
+		}
+	}
+
+	// expand against the layers below only so the result doesn't depend on map iteration order
+	expanded := make(map[string]string, len(p.Env))
+	for k, v := range p.Env {
+		expanded[k] = os.Expand(v, func(k string) string {
+			if k == "$" {
+				// escaped $$
+				return "$"
+			}
+			return lookup(k)
+		})
+	}
+	for k, v := range expanded {
+		env[k] = v
+	}
+
+	environ := make([]string, 0, len(env))
+	for k, v := range env {
+		environ = append(environ, k+"="+v)
+	}
+	slices.Sort(environ)
+	return environ, nil
+}
+
+// inherits reports whether the environment variable key of this program should be inherited by p.
+func (p Process) inherits(key string) (bool, error) {
+	if len(p.InheritOnly) > 0 {
+		allowed, err := matchAny(p.InheritOnly, key)
+		if !allowed || err != nil {
+			return false, err
+		}
+	}
+	denied, err := matchAny(p.DoNotInherit, key)
+	return !denied, err
+}
+
+// matchAny reports whether key matches any of patterns as in [path.Match].
+func matchAny(patterns []string, key string) (bool, error) {
+	for _, pattern := range patterns {
+		match, err := path.Match(pattern, key)
+		if err != nil {
+			return false, fmt.Errorf("run: env pattern %q: %w", pattern, err)
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseDotenv parses the contents of a dotenv file returning key value pairs in the order they're defined.
+//
+// Supported syntax:
+//
+//	# comments and blank lines are ignored
+//	export KEY=value       # the export prefix is optional, unquoted values are trimmed
+//	KEY='literal $value'   # single quoted values are not expanded
+//	KEY="line\n${OTHER}"   # double quoted values support \n \t \" \\ \$ escapes and may span lines
+//
+// Variables in unquoted and double quoted values are expanded with lookup, or the earlier
+// definitions in the file.
+func parseDotenv(src string, lookup func(string) string) ([][2]string, error) {
+	var vars [][2]string
+	defined := map[string]string{}
+	expand := func(s string) string {
+		return os.Expand(s, func(k string) string {
+			if v, ok := defined[k]; ok {
+				return v
+			}
+			return lookup(k)
+		})
+	}
+
+	line := 1
+	for len(src) > 0 {
+		// skip leading whitespace, blank lines and comments
+		src = strings.TrimLeftFunc(src, func(r rune) bool {
+			if r == '\n' {
+				line++
+			}
+			return unicode.IsSpace(r)
+		})
+		if src == "" {
+			break
+		}
+		if src[0] == '#' {
+			src = skipLine(src)
+			line++
+			continue
+		}
+
+		src = strings.TrimPrefix(src, "export ")
+		key, rest, ok := strings.Cut(src, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t\n") {
+			return nil, fmt.Errorf("line %d: expected KEY=value", line)
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		switch {
+		case strings.HasPrefix(rest, "'"):
+			end := strings.IndexByte(rest[1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single quote", line)
+			}
+			value = rest[1 : end+1]
+			line += strings.Count(value, "\n")
+			src = skipLine(rest[end+2:])
+			line++
+		case strings.HasPrefix(rest, `"`):
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				c := rest[i]
+				if c == '\n' {
+					line++
+				}
+				if c == '\\' && i+1 < len(rest) {
+					i++
+					switch rest[i] {
+					case 'n':
+						c = '\n'
+					case 't':
+						c = '\t'
+					case '$':
+						// environment variables can't contain NUL so it stands in for a literal $ during expansion
+						c = 0
+					default:
+						c = rest[i]
+					}
+				}
+				b.WriteByte(c)
+			}
+			if i == len(rest) {
+				return nil, fmt.Errorf("line %d: unterminated double quote", line)
+			}
+			value = strings.ReplaceAll(expand(b.String()), "\x00", "$")
+			src = skipLine(rest[i+1:])
+			line++
+		default:
+			value, src, _ = strings.Cut(rest, "\n")
+			line++
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			value = expand(strings.TrimSpace(value))
+		}
+
+		defined[key] = value
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, nil
+}
+
+// skipLine returns src after the next newline.
+func skipLine(src string) string {
+	_, rest, _ := strings.Cut(src, "\n")
+	return rest
+}
@@ -0,0 +1,93 @@
+package run_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestEnviron(t *testing.T) {
+	t.Setenv("RUN_TEST_HOME", "/home/run")
+	t.Setenv("RUN_AWS_ACCESS_KEY_ID", "secret")
+	t.Setenv("RUN_AWS_REGION", "nowhere")
+
+	t.Run("inherit", func(t *testing.T) {
+		is := is.New(t)
+		env, err := run.Process{InheritOSEnv: true, DoNotInherit: []string{"RUN_AWS_*"}}.Environ()
+		is.NoErr(err)
+		is.True(slices.Contains(env, "RUN_TEST_HOME=/home/run"))
+		is.True(!slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, "RUN_AWS_") }))
+		is.True(slices.IsSorted(env))
+
+		env, err = run.Process{InheritOSEnv: true, InheritOnly: []string{"RUN_AWS_*"}, DoNotInherit: []string{"RUN_AWS_ACCESS_KEY_ID"}}.Environ()
+		is.NoErr(err)
+		is.Equal(env, []string{"RUN_AWS_REGION=nowhere"})
+
+		// filtering implies inheriting
+		env, err = run.Process{InheritOnly: []string{"RUN_AWS_*"}}.Environ()
+		is.NoErr(err)
+		is.Equal(env, []string{"RUN_AWS_ACCESS_KEY_ID=secret", "RUN_AWS_REGION=nowhere"})
+		env, err = run.Process{DoNotInherit: []string{"RUN_AWS_*"}}.Environ()
+		is.NoErr(err)
+		is.True(slices.Contains(env, "RUN_TEST_HOME=/home/run"))
+		is.True(!slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, "RUN_AWS_") }))
+
+		_, err = run.Process{InheritOSEnv: true, DoNotInherit: []string{"["}}.Environ()
+		is.True(err != nil) // bad pattern
+
+		// an unconfigured environment is inherited
+		env, err = run.Process{}.Environ()
+		is.NoErr(err)
+		is.True(slices.Contains(env, "RUN_TEST_HOME=/home/run"))
+		env, err = run.Process{Env: map[string]string{"RUN_TEST": "1"}}.Environ()
+		is.NoErr(err)
+		is.Equal(env, []string{"RUN_TEST=1"})
+	})
+
+	t.Run("env files", func(t *testing.T) {
+		is := is.New(t)
+		dir := t.TempDir()
+		base := filepath.Join(dir, "base.env")
+		is.NoErr(os.WriteFile(base, []byte(`
+# comment
+export DATA=${RUN_TEST_HOME}/data
+NAME=base # trailing comment
+LITERAL='${NAME} stays'
+QUOTED="multi
+line\t$NAME \$NAME \"quoted\""
+`), 0o600))
+		local := filepath.Join(dir, "local.env")
+		is.NoErr(os.WriteFile(local, []byte("NAME=local-$NAME\nEMPTY=\n"), 0o600))
+
+		env, err := run.Process{
+			InheritOnly:  []string{"RUN_TEST_*"},
+			InheritOSEnv: true,
+			EnvFiles:     []string{base, local},
+			Env:          map[string]string{"LOGS": "$DATA/logs", "UNDEFINED": "[${NOPE}]", "PW": "a$$b$$"},
+		}.Environ()
+		is.NoErr(err)
+		is.Equal(env, []string{
+			"DATA=/home/run/data",
+			"EMPTY=",
+			"LITERAL=${NAME} stays",
+			"LOGS=/home/run/data/logs",
+			"NAME=local-base",
+			"PW=a$b$",
+			"QUOTED=multi\nline\tbase $NAME \"quoted\"",
+			"RUN_TEST_HOME=/home/run",
+			"UNDEFINED=[]",
+		})
+
+		is.NoErr(os.WriteFile(local, []byte("NAME=\"unterminated\n"), 0o600))
+		_, err = run.Process{EnvFiles: []string{local}}.Environ()
+		is.True(err != nil)
+
+		_, err = run.Process{EnvFiles: []string{filepath.Join(dir, "missing.env")}}.Environ()
+		is.True(err != nil)
+	})
+}
@@ -0,0 +1,238 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ExpectTimeout is the default time [Console.Expect] waits for a pattern to be matched.
+const ExpectTimeout = 10 * time.Second
+
+// ErrProcessExited is returned by [Console.Expect] when the process exited without printing the pattern.
+var ErrProcessExited = errors.New("process exited")
+
+// Console drives an interactive [Process] by waiting for it to print patterns and sending it input in
+// response, in the style of expect(1).
+//
+// Stdout and Stderr are matched against as one stream. If the process's Stdout or Stderr are set they
+// receive a copy of the output.
+type Console struct {
+	// time Expect waits for a pattern before failing, defaults to [ExpectTimeout].
+	Timeout time.Duration
+
+	stdin  *os.File
+	tty    bool
+	cancel context.CancelFunc
+	res    chan error
+	err    error
+
+	mu sync.Mutex
+	// output of the process, output[matched:] has not yet been matched by Expect
+	output  []byte
+	matched int
+	// output interleaved with input sent to the process as it would appear in a terminal
+	transcript []byte
+	// closed and replaced whenever the process writes output or exits
+	changed chan struct{}
+	exited  bool
+}
+
+// Spawn starts p returning a [Console] for interacting with it.
+//
+// The process is stopped when ctx is cancelled or [Console.Close] is called.
+func Spawn(ctx context.Context, p Process) (*Console, error) {
+	// an *os.File is passed to the process as is, os/exec would wait for a copy from any other reader to
+	// finish before reporting the process has exited
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("run.Spawn: failed to open pipe: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Console{
+		stdin:   w,
+		tty:     p.TTY != nil,
+		cancel:  cancel,
+		res:     make(chan error, 1),
+		changed: make(chan struct{}),
+	}
+	p.Stdin = r
+	p.Stdout = c.writer(p.Stdout)
+	p.Stderr = c.writer(p.Stderr)
+
+	started := make(chan struct{})
+	p.started = func(int) {
+		if p.TTY == nil {
+			// the process has its own copy, a TTY copies input from r itself
+			_ = r.Close()
+		}
+		close(started)
+	}
+	res := make(chan error, 1)
+	Go(ctx, p, res)
+	go func() {
+		err := <-res
+		_ = r.Close()
+		c.mu.Lock()
+		c.exited = true
+		c.notify()
+		c.mu.Unlock()
+		c.res <- err
+	}()
+
+	select {
+	case <-started:
+		return c, nil
+	case err := <-c.res:
+		select {
+		case <-started:
+			// started and exited before we looked
+			c.res <- err
+			return c, nil
+		default:
+		}
+		cancel()
+		return nil, err
+	}
+}
+
+// writer returns a writer recording output before writing it to w if w is not nil.
+func (c *Console) writer(w io.Writer) io.Writer {
+	return writerFunc(func(b []byte) (int, error) {
+		c.mu.Lock()
+		c.output = append(c.output, b...)
+		c.transcript = append(c.transcript, b...)
+		c.notify()
+		c.mu.Unlock()
+		if w != nil {
+			return w.Write(b)
+		}
+		return len(b), nil
+	})
+}
+
+// notify wakes up anything waiting on changed, c.mu must be held.
+func (c *Console) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Expect waits for the output of the process to match the regular expression pattern returning the match
+// and any submatches as in [regexp.Regexp.FindStringSubmatch].
+//
+// Output is only matched once, subsequent calls to Expect match output after the end of the last match.
+func (c *Console) Expect(pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return c.ExpectRegexp(re, c.Timeout)
+}
+
+// ExpectRegexp is like [Console.Expect] for a compiled regular expression failing after timeout,
+// or [ExpectTimeout] if timeout is 0.
+func (c *Console) ExpectRegexp(re *regexp.Regexp, timeout time.Duration) ([]string, error) {
+	if timeout <= 0 {
+		timeout = ExpectTimeout
+	}
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		unmatched := c.output[c.matched:]
+		if loc := re.FindSubmatchIndex(unmatched); loc != nil {
+			match := make([]string, len(loc)/2)
+			for i := range match {
+				if loc[2*i] >= 0 {
+					match[i] = string(unmatched[loc[2*i]:loc[2*i+1]])
+				}
+			}
+			c.matched += loc[1]
+			c.mu.Unlock()
+			return match, nil
+		}
+		changed, exited := c.changed, c.exited
+		c.mu.Unlock()
+
+		if exited {
+			return nil, c.expectError(re, ErrProcessExited)
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, c.expectError(re, fmt.Errorf("timed out after %s", timeout))
+		}
+	}
+}
+
+func (c *Console) expectError(re *regexp.Regexp, err error) *ExpectError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &ExpectError{Pattern: re.String(), Transcript: string(c.transcript), Err: err}
+}
+
+// Send writes s to the stdin of the process.
+func (c *Console) Send(s string) error {
+	c.mu.Lock()
+	if !c.tty {
+		// a terminal echoes input itself
+		c.transcript = append(c.transcript, s...)
+	}
+	c.mu.Unlock()
+	_, err := io.WriteString(c.stdin, s)
+	return err
+}
+
+// SendLine writes s followed by a newline to the stdin of the process.
+func (c *Console) SendLine(s string) error {
+	return c.Send(s + "\n")
+}
+
+// Transcript returns the output of the process so far interleaved with the input sent to it.
+func (c *Console) Transcript() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return string(c.transcript)
+}
+
+// Wait closes stdin of the process and waits for it to exit returning the result of [Process.Run].
+func (c *Console) Wait() error {
+	_ = c.stdin.Close()
+	if c.res != nil {
+		c.err = <-c.res
+		c.res = nil
+	}
+	return c.err
+}
+
+// Close stops the process and waits for it to exit.
+func (c *Console) Close() error {
+	c.cancel()
+	return c.Wait()
+}
+
+// ExpectError is returned by [Console.Expect] when the pattern isn't matched.
+type ExpectError struct {
+	Pattern    string
+	Transcript string
+	Err        error
+}
+
+func (e *ExpectError) Error() string {
+	return fmt.Sprintf("run.Console: expecting %q: %v\ntranscript:\n%s", e.Pattern, e.Err, e.Transcript)
+}
+
+func (e *ExpectError) Unwrap() error {
+	return e.Err
+}
+
+// writerFunc is an [io.Writer] implemented by a function.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
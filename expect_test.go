@@ -0,0 +1,68 @@
+package run_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+const interactive = `printf 'name? '; read -r name; echo "hello $name"; printf 'continue [y/N]? '; read -r yes; [ "$yes" = y ] || exit 3`
+
+func TestConsole(t *testing.T) {
+	t.Parallel()
+
+	for name, tty := range map[string]*run.TTY{"pipe": nil, "tty": {}} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			p := run.Command("bash", "-c", interactive)
+			p.TTY = tty
+			c, err := run.Spawn(t.Context(), p)
+			is.NoErr(err)
+			defer c.Close()
+
+			_, err = c.Expect(`name\? $`)
+			is.NoErr(err)
+			is.NoErr(c.SendLine("world"))
+			match, err := c.Expect(`hello (\w+)`)
+			is.NoErr(err)
+			is.Equal(match, []string{"hello world", "world"})
+			_, err = c.Expect(`\[y/N\]\? `)
+			is.NoErr(err)
+			is.NoErr(c.SendLine("y"))
+			is.NoErr(c.Wait())
+			is.True(strings.Contains(c.Transcript(), "name? world"))
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		c, err := run.Spawn(t.Context(), run.Command("bash", "-c", interactive))
+		is.NoErr(err)
+		defer c.Close()
+		c.Timeout = 50 * time.Millisecond
+		_, err = c.Expect("password:")
+		var eerr *run.ExpectError
+		is.True(errors.As(err, &eerr))
+		is.Equal(eerr.Transcript, "name? ")
+		is.True(strings.Contains(err.Error(), "timed out"))
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		c, err := run.Spawn(t.Context(), run.Command("bash", "-c", interactive))
+		is.NoErr(err)
+		is.NoErr(c.SendLine("world"))
+		is.NoErr(c.SendLine("n"))
+		_, err = c.Expect("never printed")
+		is.True(errors.Is(err, run.ErrProcessExited))
+		var perr *run.ProcessError
+		is.True(errors.As(c.Wait(), &perr)) // exit status 3
+	})
+}
@@ -2,6 +2,7 @@ module github.com/matgreaves/run
 
 go 1.25.1
 
-require github.com/matryer/is v1.4.1
-
-require al.essio.dev/pkg/shellescape v1.6.0 // indirect
+require (
+	al.essio.dev/pkg/shellescape v1.6.0
+	github.com/matryer/is v1.4.1
+)
@@ -0,0 +1,218 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var _ Runner = GoProgram{}
+
+// GoProgram is a [Runner] that builds a Go package and runs the resulting binary as a [Process].
+//
+// Unlike `go run` the binary is the process, so it is signalled and cleaned up like any other [Process].
+//
+// Binaries are cached in the user's cache directory, or a temporary directory private to this program if it
+// can't be used, keyed by a hash of the package's sources, the sources of the
+// packages it depends on and the build flags, so unchanged programs are only built once.
+type GoProgram struct {
+	// package to build as accepted by go build such as "./cmd/server" or "example.com/cmd/server".
+	Package string
+	// directory the go command is run in, usually within the module Package is in.
+	// Defaults to the working directory.
+	Dir string
+	// extra flags passed to go build such as -race or -tags.
+	BuildFlags []string
+	// build with -cover and collect coverage data into CoverDir by setting GOCOVERDIR.
+	CoverDir string
+	// the binary is run as Process with Path replaced. Name defaults to the name of the binary.
+	Process Process
+}
+
+// Run implements [Runner] building the package if needed and running it.
+func (g GoProgram) Run(ctx context.Context) error {
+	bin, err := g.Build(ctx)
+	if err != nil {
+		return err
+	}
+	p := g.Process
+	p.Path = bin
+	if p.Name == "" {
+		p.Name = filepath.Base(bin)
+	}
+	if g.CoverDir != "" {
+		if err := os.MkdirAll(g.CoverDir, 0o755); err != nil {
+			return fmt.Errorf("run.GoProgram: %w", err)
+		}
+		if len(p.Env) == 0 && len(p.EnvFiles) == 0 {
+			// keep inheriting the environment a Process that doesn't configure it inherits
+			p.InheritOSEnv = true
+		}
+		env := make(map[string]string, len(p.Env)+1)
+		for k, v := range p.Env {
+			env[k] = v
+		}
+		// Env values are expanded
+		env["GOCOVERDIR"] = strings.ReplaceAll(g.CoverDir, "$", "$$")
+		p.Env = env
+	}
+	return p.Run(ctx)
+}
+
+// goPackage is the subset of `go list -json` output used to key the build cache.
+type goPackage struct {
+	ImportPath string
+	Name       string
+	Dir        string
+	Standard   bool
+	Module     *struct {
+		Path    string
+		Version string
+		Main    bool
+		Replace *struct{ Path, Version string }
+	}
+	GoFiles, CgoFiles, CFiles, CXXFiles, HFiles, SFiles, SysoFiles, EmbedFiles []string
+}
+
+// Build builds the package, or finds it in the cache, returning the path to the binary.
+func (g GoProgram) Build(ctx context.Context) (string, error) {
+	flags := g.BuildFlags
+	if g.CoverDir != "" {
+		flags = append(flags[:len(flags):len(flags)], "-cover")
+	}
+
+	// the toolchain and target are part of the key as well as the sources
+	env, err := g.goCommand(ctx, "env", "GOVERSION", "GOOS", "GOARCH", "GOFLAGS", "CGO_ENABLED")
+	if err != nil {
+		return "", err
+	}
+	out, err := g.goCommand(ctx, append(append([]string{"list", "-deps", "-json"}, flags...), g.Package)...)
+	if err != nil {
+		return "", err
+	}
+	var main goPackage
+	h := sha256.New()
+	_, _ = h.Write(env)
+	fmt.Fprintln(h, strings.Join(flags, "\x00"))
+	for dec := json.NewDecoder(bytes.NewReader(out)); ; {
+		var pkg goPackage
+		if err := dec.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("run.GoProgram: go list: %w", err)
+		}
+		// -deps lists the package itself last
+		main = pkg
+		if err := hashPackage(h, pkg); err != nil {
+			return "", fmt.Errorf("run.GoProgram: %w", err)
+		}
+	}
+	if main.Name != "main" {
+		return "", fmt.Errorf("run.GoProgram: %s is not a main package", g.Package)
+	}
+
+	name := filepath.Base(main.ImportPath)
+	if main.Module != nil && main.ImportPath == main.Module.Path {
+		name = filepath.Base(main.Module.Path)
+	}
+	cache, err := buildCache()
+	if err != nil {
+		return "", fmt.Errorf("run.GoProgram: %w", err)
+	}
+	dir := filepath.Join(cache, hex.EncodeToString(h.Sum(nil))[:32])
+	bin := filepath.Join(dir, name)
+	if info, err := os.Lstat(bin); err == nil && info.Mode().IsRegular() && private(info) {
+		return bin, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("run.GoProgram: %w", err)
+	}
+	// build next to the cached path and rename so concurrent builds never see a partial binary
+	tmp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("run.GoProgram: %w", err)
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := g.goCommand(ctx, append(append([]string{"build", "-o", tmp.Name()}, flags...), g.Package)...); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), bin); err != nil {
+		return "", fmt.Errorf("run.GoProgram: %w", err)
+	}
+	return bin, nil
+}
+
+// buildCache returns the directory binaries are cached in, created once per program.
+var buildCache = sync.OnceValues(func() (string, error) {
+	// binaries are run so the cache mustn't be writable by other users
+	if base, err := os.UserCacheDir(); err == nil {
+		dir := filepath.Join(base, "run-go-build")
+		if err := os.MkdirAll(dir, 0o700); err == nil {
+			if info, err := os.Lstat(dir); err == nil && info.IsDir() && private(info) {
+				return dir, nil
+			}
+		}
+	}
+	return os.MkdirTemp("", "run-go-build-")
+})
+
+// private reports whether the file described by info is owned by this user and not writable by anyone else.
+func private(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid() && info.Mode().Perm()&0o022 == 0
+}
+
+// hashPackage writes everything pkg's build output depends on to h.
+func hashPackage(h io.Writer, pkg goPackage) error {
+	fmt.Fprintln(h, pkg.ImportPath)
+	if pkg.Standard {
+		// covered by the Go version
+		return nil
+	}
+	if m := pkg.Module; m != nil && !m.Main && m.Version != "" && (m.Replace == nil || m.Replace.Version != "") {
+		// the module cache is immutable so the version identifies the sources
+		fmt.Fprintln(h, m.Path, m.Version)
+		if m.Replace != nil {
+			fmt.Fprintln(h, m.Replace.Path, m.Replace.Version)
+		}
+		return nil
+	}
+	for _, files := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles, pkg.HFiles, pkg.SFiles, pkg.SysoFiles, pkg.EmbedFiles} {
+		for _, fn := range files {
+			b, err := os.ReadFile(filepath.Join(pkg.Dir, fn))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(h, fn, len(b))
+			_, _ = h.Write(b)
+		}
+	}
+	return nil
+}
+
+// goCommand runs the go command with args returning its stdout.
+func (g GoProgram) goCommand(ctx context.Context, args ...string) ([]byte, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	p := Command("go", args...)
+	p.Dir = g.Dir
+	p.Stdout, p.Stderr = stdout, stderr
+	if err := p.Run(ctx); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("run.GoProgram: go %s: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
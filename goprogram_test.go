@@ -0,0 +1,68 @@
+package run_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestGoProgram(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir := t.TempDir()
+	is.NoErr(os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/hello\n\ngo 1.25\n"), 0o644))
+	writeMain := func(greeting string) {
+		is.NoErr(os.WriteFile(filepath.Join(dir, "main.go"), []byte(`package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Println("`+greeting+`,", os.Args[1], os.Getenv("PATH") != "")
+}
+`), 0o644))
+	}
+	writeMain("Hello")
+
+	buf := &bytes.Buffer{}
+	cover := t.TempDir()
+	g := run.GoProgram{
+		Package:  ".",
+		Dir:      dir,
+		CoverDir: cover,
+		Process:  run.Process{Args: []string{"World!"}, Stdout: buf},
+	}
+	is.NoErr(g.Run(t.Context()))
+	// the environment is still inherited with GOCOVERDIR set
+	is.Equal(buf.String(), "Hello, World! true\n")
+	covdata, err := os.ReadDir(cover)
+	is.NoErr(err)
+	is.True(len(covdata) > 0)
+
+	bin, err := g.Build(t.Context())
+	is.NoErr(err)
+	is.Equal(filepath.Base(bin), "hello")
+	cached, err := g.Build(t.Context())
+	is.NoErr(err)
+	is.Equal(cached, bin) // unchanged sources are cached
+
+	// a cached binary others could have replaced is rebuilt
+	is.NoErr(os.Chmod(bin, 0o777))
+	cached, err = g.Build(t.Context())
+	is.NoErr(err)
+	is.Equal(cached, bin)
+	info, err := os.Stat(bin)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm()&0o022, os.FileMode(0))
+
+	writeMain("Goodbye")
+	rebuilt, err := g.Build(t.Context())
+	is.NoErr(err)
+	is.True(rebuilt != bin)
+}
@@ -0,0 +1,61 @@
+package run
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Handle is a [Process] that has been started, passed to [Process.OnStart].
+type Handle struct {
+	// pid of the process
+	Pid int
+	// process group of the process, signals sent to the group reach its children too.
+	Pgid int
+	// time the process was started
+	StartTime time.Time
+
+	process *os.Process
+	done    <-chan struct{}
+}
+
+// Signal sends sig to the process. It returns [os.ErrProcessDone] if the process has exited.
+func (h *Handle) Signal(sig os.Signal) error {
+	return h.process.Signal(sig)
+}
+
+// SignalGroup sends sig to the process group of the process.
+// It returns [os.ErrProcessDone] if the process has exited.
+func (h *Handle) SignalGroup(sig syscall.Signal) error {
+	if !h.Alive() {
+		return os.ErrProcessDone
+	}
+	return syscall.Kill(-h.Pgid, sig)
+}
+
+// Pause stops the process group with a SIGSTOP until [Handle.Resume] is called.
+//
+// A paused process is resumed when it is stopped so it can handle [Process.StopSignal].
+func (h *Handle) Pause() error {
+	return h.SignalGroup(syscall.SIGSTOP)
+}
+
+// Resume continues a process group stopped with [Handle.Pause].
+func (h *Handle) Resume() error {
+	return h.SignalGroup(syscall.SIGCONT)
+}
+
+// Done returns a channel that is closed once the process has exited and been reaped.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Alive reports whether the process is still running.
+func (h *Handle) Alive() bool {
+	select {
+	case <-h.done:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,60 @@
+package run_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestHandle(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	handles := make(chan *run.Handle, 1)
+	p := run.Command("sleep", "60")
+	p.StopTimeout = 5 * time.Second
+	p.OnStart = func(h *run.Handle) { handles <- h }
+	res := make(chan error, 1)
+	run.Go(ctx, p, res)
+	h := <-handles
+	is.Equal(h.Pgid, h.Pid)
+	is.True(h.Alive())
+
+	is.NoErr(h.Pause())
+	waitState(t, h.Pid, 'T')
+	is.NoErr(h.Resume())
+	waitState(t, h.Pid, 'S')
+
+	// a paused process still stops promptly
+	is.NoErr(h.Pause())
+	waitState(t, h.Pid, 'T')
+	start := time.Now()
+	cancel()
+	<-h.Done()
+	is.True(time.Since(start) < p.StopTimeout)
+	is.True(<-res != nil) // interrupted
+	is.True(!h.Alive())
+	is.True(errors.Is(h.Signal(syscall.SIGTERM), os.ErrProcessDone))
+	is.True(errors.Is(h.Pause(), os.ErrProcessDone))
+}
+
+// waitState waits for the process pid to be in state as reported by /proc/<pid>/stat.
+func waitState(t *testing.T, pid int, state byte) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stat, _ := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if _, after, _ := bytes.Cut(stat, []byte(") ")); len(after) > 0 && after[0] == state {
+			return
+		}
+	}
+	t.Fatalf("process %d not in state %c", pid, state)
+}
@@ -0,0 +1,76 @@
+// Package procfs reads the state of processes from /proc.
+package procfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Stat is a process as observed through /proc/<pid>/stat.
+type Stat struct {
+	Pid   int
+	Ppid  int
+	Pgid  int
+	State byte
+	// time the process started in clock ticks after boot, telling it apart from a later process reusing
+	// the same pid
+	Start uint64
+	// CPU time in user and kernel mode in clock ticks
+	Utime, Stime uint64
+	Threads      int
+}
+
+// ErrFormat is returned for a /proc/<pid>/stat file that can't be parsed.
+var ErrFormat = errors.New("unexpected /proc/<pid>/stat format")
+
+// Read reads the stat of the process pid.
+func Read(pid int) (Stat, error) {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return Stat{}, err
+	}
+	return Parse(b)
+}
+
+// Parse parses the contents of a /proc/<pid>/stat file.
+func Parse(b []byte) (Stat, error) {
+	// comm is wrapped in parentheses and may itself contain spaces and parentheses so
+	// fields are split from the last closing parenthesis.
+	open, end := bytes.IndexByte(b, '('), bytes.LastIndexByte(b, ')')
+	if open < 0 || end < open {
+		return Stat{}, ErrFormat
+	}
+	fields := bytes.Fields(b[end+1:])
+	// fields[0] is field 3 (state) of proc_pid_stat(5) so field n is fields[n-3].
+	if len(fields) < 20 {
+		return Stat{}, ErrFormat
+	}
+	var s Stat
+	var err error
+	if s.Pid, err = strconv.Atoi(string(bytes.TrimSpace(b[:open]))); err != nil {
+		return Stat{}, fmt.Errorf("%w: pid: %w", ErrFormat, err)
+	}
+	s.State = fields[0][0]
+	if s.Ppid, err = strconv.Atoi(string(fields[1])); err != nil {
+		return Stat{}, fmt.Errorf("%w: ppid: %w", ErrFormat, err)
+	}
+	if s.Pgid, err = strconv.Atoi(string(fields[2])); err != nil {
+		return Stat{}, fmt.Errorf("%w: pgrp: %w", ErrFormat, err)
+	}
+	if s.Utime, err = strconv.ParseUint(string(fields[11]), 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("%w: utime: %w", ErrFormat, err)
+	}
+	if s.Stime, err = strconv.ParseUint(string(fields[12]), 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("%w: stime: %w", ErrFormat, err)
+	}
+	if s.Threads, err = strconv.Atoi(string(fields[17])); err != nil {
+		return Stat{}, fmt.Errorf("%w: num_threads: %w", ErrFormat, err)
+	}
+	if s.Start, err = strconv.ParseUint(string(fields[19]), 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("%w: starttime: %w", ErrFormat, err)
+	}
+	return s, nil
+}
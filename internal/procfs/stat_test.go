@@ -0,0 +1,19 @@
+package procfs_test
+
+import (
+	"testing"
+
+	"github.com/matgreaves/run/internal/procfs"
+	"github.com/matryer/is"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	s, err := procfs.Parse([]byte("4242 (a) b (c)) S 1 4240 4240 0 -1 4194560 96 0 0 0 7 3 0 0 20 0 2 0 123456 5558272 192 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 3 0 0 0 0 0\n"))
+	is.NoErr(err)
+	is.Equal(s, procfs.Stat{Pid: 4242, Ppid: 1, Pgid: 4240, State: 'S', Start: 123456, Utime: 7, Stime: 3, Threads: 2})
+
+	_, err = procfs.Parse([]byte("4242 (truncated"))
+	is.True(err != nil)
+}
@@ -0,0 +1,49 @@
+package run
+
+import "strconv"
+
+// Resource is a process resource that can be limited with setrlimit(2).
+//
+// Values are numbered as on Linux.
+type Resource int
+
+const (
+	RlimitCPU        Resource = 0  // CPU time in seconds, SIGXCPU is sent at the soft limit and SIGKILL at the hard limit
+	RlimitFSize      Resource = 1  // largest file the process may create in bytes, SIGXFSZ is sent when exceeded
+	RlimitData       Resource = 2  // size of the data segment in bytes
+	RlimitStack      Resource = 3  // size of the stack in bytes
+	RlimitCore       Resource = 4  // size of core dumps in bytes, 0 disables core dumps
+	RlimitRSS        Resource = 5  // resident set size in bytes
+	RlimitNProc      Resource = 6  // number of processes for the real user ID of the process
+	RlimitNoFile     Resource = 7  // one greater than the largest file descriptor the process may open
+	RlimitMemLock    Resource = 8  // bytes of memory that may be locked into RAM
+	RlimitAS         Resource = 9  // size of the virtual address space in bytes
+	RlimitLocks      Resource = 10 // number of file locks
+	RlimitSigPending Resource = 11 // number of signals that may be queued
+	RlimitMsgQueue   Resource = 12 // bytes allocated for POSIX message queues
+	RlimitNice       Resource = 13 // ceiling of the nice value
+	RlimitRTPrio     Resource = 14 // ceiling of the real-time priority
+	RlimitRTTime     Resource = 15 // CPU time in microseconds a real-time process may consume without blocking
+)
+
+// RlimInfinity used as a limit means the resource is unlimited.
+const RlimInfinity = ^uint64(0)
+
+// Rlimit is the soft (Cur) and hard (Max) limit of a [Resource].
+type Rlimit struct {
+	Cur uint64
+	Max uint64
+}
+
+var resourceNames = [...]string{
+	"RLIMIT_CPU", "RLIMIT_FSIZE", "RLIMIT_DATA", "RLIMIT_STACK", "RLIMIT_CORE", "RLIMIT_RSS",
+	"RLIMIT_NPROC", "RLIMIT_NOFILE", "RLIMIT_MEMLOCK", "RLIMIT_AS", "RLIMIT_LOCKS",
+	"RLIMIT_SIGPENDING", "RLIMIT_MSGQUEUE", "RLIMIT_NICE", "RLIMIT_RTPRIO", "RLIMIT_RTTIME",
+}
+
+func (r Resource) String() string {
+	if r >= 0 && int(r) < len(resourceNames) {
+		return resourceNames[r]
+	}
+	return "Resource(" + strconv.Itoa(int(r)) + ")"
+}
@@ -0,0 +1,121 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// start starts cmd applying limits before the program runs.
+//
+// The process is traced with ptrace(2) so it stops as soon as it has been executed, before running a single
+// instruction of the program or starting any process, then limits are applied with prlimit(2) and the
+// process is detached to continue.
+//
+// Where ptrace is denied, or the program is privileged which exec drops under ptrace, limits are applied
+// once the process has started instead.
+func start(cmd *exec.Cmd, limits map[Resource]Rlimit) error {
+	if len(limits) == 0 {
+		return cmd.Start()
+	}
+	if !canTrace() || privileged(cmd.Path) {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		if err := setLimits(cmd.Process.Pid, limits); err != nil {
+			_ = syscall.Kill(cmd.Process.Pid, syscall.SIGKILL)
+			_ = cmd.Wait()
+			return fmt.Errorf("run: failed to set limits: %w", err)
+		}
+		return nil
+	}
+	// ptrace requests must come from the thread that started the tracee
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cmd.SysProcAttr.Ptrace = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	err := waitExecStop(pid)
+	if err == nil {
+		err = setLimits(pid, limits)
+	}
+	if err == nil {
+		// detaching continues the process without delivering the SIGTRAP of exec
+		err = syscall.PtraceDetach(pid)
+	}
+	if err != nil {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+		_ = cmd.Wait()
+		return fmt.Errorf("run: failed to set limits: %w", err)
+	}
+	return nil
+}
+
+// canTrace reports whether processes can be started traced, which Yama, seccomp profiles and sandboxes may
+// deny. It is checked once by starting this program traced and killing it at its exec stop, before it runs.
+var canTrace = sync.OnceValue(func() bool {
+	path, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	p, err := os.StartProcess(path, []string{path}, &os.ProcAttr{Sys: &syscall.SysProcAttr{Ptrace: true}})
+	if err != nil {
+		return false
+	}
+	err = waitExecStop(p.Pid)
+	_ = p.Kill()
+	_, _ = p.Wait()
+	return err == nil
+})
+
+// privileged reports whether the program at path is setuid, setgid or has file capabilities, privileges
+// which exec ignores for a traced process.
+func privileged(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return true
+	}
+	n, err := syscall.Getxattr(path, "security.capability", nil)
+	return err == nil && n > 0
+}
+
+// waitExecStop waits for the traced process pid to stop after being executed.
+func waitExecStop(pid int) error {
+	var ws syscall.WaitStatus
+	for {
+		_, err := syscall.Wait4(pid, &ws, syscall.WALL, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !ws.Stopped() {
+			return fmt.Errorf("process exited before it could be limited: %v", ws)
+		}
+		return nil
+	}
+}
+
+// setLimits applies limits to the process pid with prlimit(2).
+func setLimits(pid int, limits map[Resource]Rlimit) error {
+	for r, l := range limits {
+		lim := syscall.Rlimit{Cur: l.Cur, Max: l.Max}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(r), uintptr(unsafe.Pointer(&lim)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("prlimit %s: %w", r, errno)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package run
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+func start(cmd *exec.Cmd, limits map[Resource]Rlimit) error {
+	if len(limits) > 0 {
+		return fmt.Errorf("run: resource limits: %w", errors.ErrUnsupported)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,230 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logWriter re-emits each line of output written to it as a record of logger, see [Process.Logger].
+// Each output stream needs its own logWriter so partial lines aren't mixed.
+//
+// JSON objects and logfmt lines keep their time, level, message and attributes. Any other line is
+// logged as the message of an info record.
+type logWriter struct {
+	ctx    context.Context
+	logger *slog.Logger
+	name   string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newLogWriter(ctx context.Context, logger *slog.Logger, name string) *logWriter {
+	return &logWriter{ctx: ctx, logger: logger, name: name}
+}
+
+// writer returns a writer logging each line written to it, and writing to w if w is not nil.
+func (l *logWriter) writer(w io.Writer) io.Writer {
+	if w == nil {
+		return l
+	}
+	return io.MultiWriter(l, w)
+}
+
+func (l *logWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(string(bytes.TrimSuffix(l.buf[:i], []byte{'\r'})))
+		l.buf = l.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// flush logs the last line if it wasn't terminated by a newline.
+func (l *logWriter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.log(string(l.buf))
+		l.buf = nil
+	}
+}
+
+func (l *logWriter) log(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	r, ok := parseJSONRecord(line)
+	if !ok {
+		r, ok = parseLogfmtRecord(line)
+	}
+	if !ok {
+		r = slog.NewRecord(time.Now(), slog.LevelInfo, line, 0)
+	}
+	if !l.logger.Enabled(l.ctx, r.Level) {
+		return
+	}
+	r.AddAttrs(slog.String("process", l.name))
+	_ = l.logger.Handler().Handle(l.ctx, r)
+}
+
+// logRecord builds a record from attributes of a structured log line, taking the time, level and message
+// from the keys commonly used for them.
+func logRecord(attrs []slog.Attr) slog.Record {
+	t, level, msg := time.Now(), slog.LevelInfo, ""
+	rest := attrs[:0:0]
+	for _, a := range attrs {
+		switch strings.ToLower(a.Key) {
+		case "time", "ts", "timestamp":
+			if parsed, err := time.Parse(time.RFC3339Nano, a.Value.String()); err == nil {
+				t = parsed
+				continue
+			}
+		case "level", "lvl", "severity":
+			if parsed, ok := parseLevel(a.Value.String()); ok {
+				level = parsed
+				continue
+			}
+		case "msg", "message":
+			if msg == "" {
+				msg = a.Value.String()
+				continue
+			}
+		}
+		rest = append(rest, a)
+	}
+	r := slog.NewRecord(t, level, msg, 0)
+	r.AddAttrs(rest...)
+	return r
+}
+
+// parseLevel parses the levels of [slog.Level] as well as common names used by other loggers.
+func parseLevel(s string) (slog.Level, bool) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return slog.LevelDebug - 4, true
+	case "warning":
+		return slog.LevelWarn, true
+	case "fatal", "panic", "critical", "crit":
+		return slog.LevelError + 4, true
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// parseJSONRecord parses a line holding a JSON object such as those written by [slog.JSONHandler].
+func parseJSONRecord(line string) (slog.Record, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return slog.Record{}, false
+	}
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	attrs, err := decodeJSONObject(dec)
+	if err != nil || dec.More() {
+		return slog.Record{}, false
+	}
+	return logRecord(attrs), true
+}
+
+// decodeJSONObject decodes the next object from dec into attributes keeping the order of its keys.
+// Nested objects become groups.
+func decodeJSONObject(dec *json.Decoder) ([]slog.Attr, error) {
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var attrs []slog.Attr
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if len(raw) > 0 && raw[0] == '{' {
+			inner := json.NewDecoder(bytes.NewReader(raw))
+			inner.UseNumber()
+			group, err := decodeJSONObject(inner)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, slog.Attr{Key: key, Value: slog.GroupValue(group...)})
+			continue
+		}
+		var v any
+		inner := json.NewDecoder(bytes.NewReader(raw))
+		inner.UseNumber()
+		if err := inner.Decode(&v); err != nil {
+			return nil, err
+		}
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else if f, err := n.Float64(); err == nil {
+				v = f
+			}
+		}
+		attrs = append(attrs, slog.Any(key, v))
+	}
+	_, err := dec.Token()
+	return attrs, err
+}
+
+// parseLogfmtRecord parses a line of key=value pairs such as those written by [slog.TextHandler].
+//
+// Lines are only treated as logfmt if every field is a key=value pair and one of them is a level or message
+// so plain text containing an = isn't mistaken for a record.
+func parseLogfmtRecord(line string) (slog.Record, bool) {
+	var attrs []slog.Attr
+	structured := false
+	for s := strings.TrimSpace(line); s != ""; s = strings.TrimLeft(s, " \t") {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || strings.ContainsAny(s[:eq], " \t\"") {
+			return slog.Record{}, false
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return slog.Record{}, false
+			}
+			value, _ = strconv.Unquote(quoted)
+			s = s[len(quoted):]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		switch strings.ToLower(key) {
+		case "level", "lvl", "msg", "message":
+			structured = true
+		}
+		attrs = append(attrs, slog.String(key, value))
+	}
+	if !structured {
+		return slog.Record{}, false
+	}
+	return logRecord(attrs), true
+}
@@ -0,0 +1,49 @@
+package run_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestProcessLogger(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	p := run.Command("bash", "-c", `
+echo '{"time":"2024-01-02T03:04:05Z","level":"WARN","msg":"json","n":1,"req":{"id":"a"}}'
+echo 'level=debug msg="log fmt" user=bob'
+echo 'plain text' >&2
+printf 'partial'`)
+	p.Name = "svc"
+	p.Logger = logger
+	is.NoErr(p.Run(t.Context()))
+
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var r map[string]any
+		is.NoErr(dec.Decode(&r))
+		records = append(records, r)
+	}
+	is.Equal(len(records), 4)
+	byMsg := map[string]map[string]any{}
+	for _, r := range records {
+		is.Equal(r["process"], "svc")
+		byMsg[r["msg"].(string)] = r
+	}
+
+	is.Equal(byMsg["json"]["level"], "WARN")
+	is.Equal(byMsg["json"]["time"], "2024-01-02T03:04:05Z")
+	is.Equal(byMsg["json"]["n"], 1.0)
+	is.Equal(byMsg["json"]["req"], map[string]any{"id": "a"})
+	is.Equal(byMsg["log fmt"]["level"], "DEBUG")
+	is.Equal(byMsg["log fmt"]["user"], "bob")
+	is.Equal(byMsg["plain text"]["level"], "INFO")
+	is.Equal(byMsg["partial"]["level"], "INFO")
+}
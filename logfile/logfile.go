@@ -0,0 +1,254 @@
+// logfile is a package for writing the output of long running processes to files on disk that are
+// rotated so they don't grow without bound.
+//
+// A [File] can be used directly as the Stdout or Stderr of a [github.com/matgreaves/run.Process], or
+// combined with [io.MultiWriter] to also tee the output to the terminal:
+//
+//	logs := &logfile.File{Path: "api.log", MaxSize: 10 << 20, MaxBackups: 3, Compress: true}
+//	defer logs.Close()
+//	p := run.Command("api")
+//	p.Stdout = io.MultiWriter(os.Stdout, logs)
+//	p.Stderr = p.Stdout
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backupTimeFormat is appended to Path to name backups, it sorts in the order backups are created.
+const backupTimeFormat = "20060102T150405.000000000"
+
+var _ io.WriteCloser = &File{}
+
+// File is an [io.WriteCloser] appending to the file at Path, rotating it into a backup named after the
+// time of the rotation once it exceeds MaxSize or has been written to for longer than Every.
+//
+// File is safe to be used by concurrent writers. The file is opened, and its directory created, on the first
+// write. The zero value of every option disables it.
+type File struct {
+	// path of the file written to, backups are written to the same directory.
+	Path string
+	// rotate before the file grows beyond MaxSize bytes.
+	MaxSize int64
+	// rotate once the file has been written to for longer than Every.
+	Every time.Duration
+	// number of backups to keep, deleting the oldest.
+	MaxBackups int
+	// gzip backups.
+	Compress bool
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	// serialises compressing and removing backups in the background
+	bg   sync.Mutex
+	bgWG sync.WaitGroup
+}
+
+// Write implements [io.Writer] rotating the file first if needed.
+func (f *File) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	full := f.MaxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.MaxSize
+	expired := f.Every > 0 && time.Since(f.opened) >= f.Every
+	if full || expired {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file to a backup and starts writing to a new file at Path.
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	return f.rotate()
+}
+
+// Reopen closes and reopens the file at Path without rotating it.
+//
+// This is useful when another program such as logrotate moves the file.
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.closeFile(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// ReopenOnSIGHUP calls [File.Reopen] whenever this program receives a SIGHUP until stop is called.
+//
+// Note that while any channel is notified of SIGHUP the signal no longer terminates this program. A program
+// also using [github.com/matgreaves/run/onexit.Defer] should leave SIGHUP out of its signals with
+// [github.com/matgreaves/run/onexit.SetupDefer] so a SIGHUP reopens the file instead of exiting.
+func (f *File) ReopenOnSIGHUP() (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hup:
+				_ = f.Reopen()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return sync.OnceFunc(func() {
+		signal.Stop(hup)
+		close(done)
+	})
+}
+
+// Close closes the file waiting for backups to be compressed and removed.
+func (f *File) Close() error {
+	f.mu.Lock()
+	err := f.closeFile()
+	f.mu.Unlock()
+	f.bgWG.Wait()
+	return err
+}
+
+// open opens the file at f.Path, f.mu must be held.
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+		return fmt.Errorf("logfile: %w", err)
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("logfile: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("logfile: %w", err)
+	}
+	f.f, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// closeFile closes the current file if open, f.mu must be held.
+func (f *File) closeFile() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	if err != nil {
+		return fmt.Errorf("logfile: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the open file to a backup and opens a new one, f.mu must be held.
+func (f *File) rotate() error {
+	if err := f.closeFile(); err != nil {
+		return err
+	}
+	backup := f.Path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.Path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("logfile: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.bgWG.Go(func() {
+		f.bg.Lock()
+		defer f.bg.Unlock()
+		if f.Compress {
+			_ = compress(backup)
+		}
+		_ = f.prune()
+	})
+	return nil
+}
+
+// compress gzips fn replacing it with fn.gz.
+func compress(fn string) error {
+	src, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(fn+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Close())
+	if err != nil {
+		_ = os.Remove(fn + ".gz")
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// prune removes the oldest backups leaving f.MaxBackups.
+func (f *File) prune() error {
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the paths of the backups of the file from oldest to newest.
+func (f *File) Backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(f.Path))
+	if err != nil {
+		return nil, fmt.Errorf("logfile: %w", err)
+	}
+	prefix := filepath.Base(f.Path) + "."
+	var backups []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ".gz")); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(f.Path), e.Name()))
+	}
+	slices.Sort(backups)
+	return backups, nil
+}
@@ -0,0 +1,126 @@
+package logfile_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run/logfile"
+	"github.com/matryer/is"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	t.Run("rotate on size", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		fn := filepath.Join(t.TempDir(), "logs", "app.log")
+		f := &logfile.File{Path: fn, MaxSize: 10, MaxBackups: 2, Compress: true}
+		for i := range 5 {
+			_, err := fmt.Fprintf(f, "line %d\n", i)
+			is.NoErr(err)
+		}
+		is.NoErr(f.Close())
+
+		current, err := os.ReadFile(fn)
+		is.NoErr(err)
+		is.Equal(string(current), "line 4\n")
+		backups, err := f.Backups()
+		is.NoErr(err)
+		is.Equal(len(backups), 2)
+		is.Equal(readGzip(t, backups[0]), "line 2\n")
+		is.Equal(readGzip(t, backups[1]), "line 3\n")
+	})
+
+	t.Run("rotate on time", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		fn := filepath.Join(t.TempDir(), "app.log")
+		f := &logfile.File{Path: fn, Every: 20 * time.Millisecond}
+		_, err := io.WriteString(f, "before\n")
+		is.NoErr(err)
+		time.Sleep(30 * time.Millisecond)
+		_, err = io.WriteString(f, "after\n")
+		is.NoErr(err)
+		is.NoErr(f.Close())
+
+		backups, err := f.Backups()
+		is.NoErr(err)
+		is.Equal(len(backups), 1)
+		backup, err := os.ReadFile(backups[0])
+		is.NoErr(err)
+		is.Equal(string(backup), "before\n")
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		fn := filepath.Join(t.TempDir(), "app.log")
+		f := &logfile.File{Path: fn}
+		defer f.Close()
+		_, err := io.WriteString(f, "one\n")
+		is.NoErr(err)
+		// moved by another program
+		is.NoErr(os.Rename(fn, fn+".moved"))
+		is.NoErr(f.Reopen())
+		_, err = io.WriteString(f, "two\n")
+		is.NoErr(err)
+
+		current, err := os.ReadFile(fn)
+		is.NoErr(err)
+		is.Equal(string(current), "two\n")
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		fn := filepath.Join(t.TempDir(), "app.log")
+		f := &logfile.File{Path: fn, MaxSize: 1 << 10}
+		var wg sync.WaitGroup
+		for w := range 8 {
+			wg.Go(func() {
+				for i := range 100 {
+					fmt.Fprintf(f, "writer %d line %d\n", w, i)
+				}
+			})
+		}
+		wg.Wait()
+		is.NoErr(f.Close())
+
+		backups, err := f.Backups()
+		is.NoErr(err)
+		var lines int
+		for _, fn := range append(backups, fn) {
+			b, err := os.ReadFile(fn)
+			is.NoErr(err)
+			is.True(len(b) <= 1<<10)
+			lines += strings.Count(string(b), "\n")
+		}
+		is.Equal(lines, 800)
+	})
+}
+
+func readGzip(t *testing.T, fn string) string {
+	t.Helper()
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
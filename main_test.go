@@ -0,0 +1,13 @@
+package run_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/matgreaves/run"
+)
+
+func TestMain(m *testing.M) {
+	run.RunSubprocess()
+	os.Exit(m.Run())
+}
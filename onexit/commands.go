@@ -0,0 +1,214 @@
+package onexit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"al.essio.dev/pkg/shellescape"
+)
+
+// KillGroupWait is the time [Killer.KillGroup] waits for a process group to exit before sending the next
+// signal.
+const KillGroupWait = 5 * time.Second
+
+// RemoveAll removes path and everything it contains like [os.RemoveAll].
+//
+// Relative paths are resolved against the working directory now. Removing "/", the home directory or any
+// directory containing it is refused, also through symlinks, as is an empty path which would resolve to the
+// working directory.
+func (k *Killer) RemoveAll(path string) (cancel func() error, _ error) {
+	path, err := checkRemovable(path)
+	if err != nil {
+		return nil, err
+	}
+	words, err := quote(path)
+	if err != nil {
+		return nil, err
+	}
+	return k.queue(opRm, 0, words)
+}
+
+// checkRemovable returns the absolute path of path unless [Killer.RemoveAll] refuses to remove it.
+func checkRemovable(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("onexit: remove all: empty path")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("onexit: remove all: %w", err)
+	}
+	paths := []string{path}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		paths = append(paths, resolved)
+	}
+	homes := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		homes = append(homes, filepath.Clean(home))
+		if resolved, err := filepath.EvalSymlinks(home); err == nil {
+			homes = append(homes, resolved)
+		}
+	}
+	for _, p := range paths {
+		if p == "/" {
+			return "", fmt.Errorf("onexit: refusing to remove %s resolving to /", path)
+		}
+		for _, home := range homes {
+			if rel, err := filepath.Rel(p, home); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+				return "", fmt.Errorf("onexit: refusing to remove %s containing the home directory", path)
+			}
+		}
+	}
+	return path, nil
+}
+
+// KillGroup sends each of signals to the process group pgid in turn until the group has exited, waiting up
+// to [KillGroupWait] after each. With no signals SIGKILL is sent.
+func (k *Killer) KillGroup(pgid int, signals ...syscall.Signal) (cancel func() error, _ error) {
+	if pgid <= 0 {
+		return nil, fmt.Errorf("onexit: invalid process group %d", pgid)
+	}
+	if len(signals) == 0 {
+		signals = []syscall.Signal{syscall.SIGKILL}
+	}
+	return k.terminate(fmt.Sprintf("process group %d", pgid), -pgid, signals, KillGroupWait)
+}
+
+// Unmount unmounts the filesystem mounted at path.
+//
+// Relative paths are resolved against the working directory now. An empty path is refused.
+func (k *Killer) Unmount(path string) (cancel func() error, _ error) {
+	if path == "" {
+		return nil, errors.New("onexit: unmount: empty path")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("onexit: unmount: %w", err)
+	}
+	words, err := quote(path)
+	if err != nil {
+		return nil, err
+	}
+	return k.queue(opUmount, PriorityUnmount, words)
+}
+
+// RunArgv runs the program argv[0] with the arguments argv[1:] without a shell.
+func (k *Killer) RunArgv(argv ...string) (cancel func() error, _ error) {
+	if len(argv) == 0 {
+		return nil, errors.New("onexit: empty argv")
+	}
+	words, err := quote(argv...)
+	if err != nil {
+		return nil, err
+	}
+	return k.queue(opArgv, 0, words)
+}
+
+// WriteFile writes data to the existing file path, truncating it, such as to write to a control file of a
+// kernel filesystem without a shell.
+//
+// Relative paths are resolved against the working directory now. An empty path is refused.
+func (k *Killer) WriteFile(path, data string) (cancel func() error, _ error) {
+	if path == "" {
+		return nil, errors.New("onexit: write file: empty path")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("onexit: write file: %w", err)
+	}
+	words, err := quote(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return k.queue(opWrite, 0, words)
+}
+
+// quote quotes words to be split by splitWords in the Go helper or eval in onexit.sh.
+func quote(words ...string) (string, error) {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		// newlines separate operations
+		if strings.ContainsAny(w, "\n\x00") {
+			return "", fmt.Errorf("onexit: %q contains a newline or NUL", w)
+		}
+		quoted[i] = shellescape.Quote(w)
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// splitWords splits s into words quoted by a shell such as by quote.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in %q", s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quote in %q", s)
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// RemoveAll runs [DefaultKiller.RemoveAll].
+func RemoveAll(path string) (cancel func() error, _ error) {
+	return DefaultKiller.RemoveAll(path)
+}
+
+// KillGroup runs [DefaultKiller.KillGroup].
+func KillGroup(pgid int, signals ...syscall.Signal) (cancel func() error, _ error) {
+	return DefaultKiller.KillGroup(pgid, signals...)
+}
+
+// Unmount runs [DefaultKiller.Unmount].
+func Unmount(path string) (cancel func() error, _ error) {
+	return DefaultKiller.Unmount(path)
+}
+
+// RunArgv runs [DefaultKiller.RunArgv].
+func RunArgv(argv ...string) (cancel func() error, _ error) {
+	return DefaultKiller.RunArgv(argv...)
+}
+
+// WriteFile runs [DefaultKiller.WriteFile].
+func WriteFile(path, data string) (cancel func() error, _ error) {
+	return DefaultKiller.WriteFile(path, data)
+}
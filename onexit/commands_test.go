@@ -0,0 +1,156 @@
+package onexit
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			k, err := New(Options{Helper: helper})
+			is.NoErr(err)
+
+			dir := t.TempDir()
+			remove := filepath.Join(dir, `it's a "$dir"`)
+			is.NoErr(os.MkdirAll(filepath.Join(remove, "nested"), 0o755))
+			_, err = k.RemoveAll(remove)
+			is.NoErr(err)
+
+			touched := filepath.Join(dir, "touched by `argv` $(false)")
+			_, err = k.RunArgv("touch", touched)
+			is.NoErr(err)
+
+			written := filepath.Join(dir, "written")
+			is.NoErr(os.WriteFile(written, []byte("truncated"), 0o644))
+			_, err = k.WriteFile(written, `it's "$1"`)
+			is.NoErr(err)
+
+			sleep := exec.Command("sleep", "60")
+			sleep.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			is.NoErr(sleep.Start())
+			exited := make(chan error, 1)
+			go func() { exited <- sleep.Wait() }()
+			_, err = k.KillGroup(sleep.Process.Pid)
+			is.NoErr(err)
+
+			is.NoErr(k.Close())
+			select {
+			case <-exited:
+				is.Equal(sleep.ProcessState.Sys().(syscall.WaitStatus).Signal(), syscall.SIGKILL)
+			case <-time.After(5 * time.Second):
+				t.Fatal("process group was not killed")
+			}
+			waitFor(t, func() bool {
+				_, errRemoved := os.Stat(remove)
+				_, errTouched := os.Stat(touched)
+				contents, _ := os.ReadFile(written)
+				return errors.Is(errRemoved, os.ErrNotExist) && errTouched == nil && string(contents) == `it's "$1"`
+			})
+		})
+	}
+
+	t.Run("guards", func(t *testing.T) {
+		t.Parallel()
+
+		is := is.New(t)
+		home, err := os.UserHomeDir()
+		is.NoErr(err)
+		dir := t.TempDir()
+		is.NoErr(os.Symlink(home, filepath.Join(dir, "home")))
+		is.NoErr(os.Symlink("/", filepath.Join(dir, "root")))
+		// checked without queueing anything so a broken guard can't remove them when the test exits
+		for _, path := range []string{"/", home, filepath.Dir(home), home + "/", "", filepath.Join(dir, "home"), filepath.Join(dir, "root")} {
+			_, err := checkRemovable(path)
+			is.True(err != nil) // refused
+		}
+		path, err := checkRemovable(filepath.Join(dir, "missing"))
+		is.NoErr(err)
+		is.Equal(path, filepath.Join(dir, "missing"))
+
+		k, err := New(Options{})
+		is.NoErr(err)
+		defer k.Close()
+		_, err = k.Unmount("")
+		is.True(err != nil)
+		_, err = k.WriteFile("", "1")
+		is.True(err != nil)
+		_, err = k.RunArgv()
+		is.True(err != nil)
+		_, err = k.RunArgv("echo", "two\nlines")
+		is.True(err != nil)
+		_, err = k.KillGroup(0)
+		is.True(err != nil)
+	})
+}
+
+// directory TestNestedChild creates a file in when run by TestNested
+const nestedDirEnv = "ONEXIT_TEST_NESTED_DIR"
+
+func TestNested(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			k, err := New(Options{Helper: helper})
+			is.NoErr(err)
+			dir := t.TempDir()
+
+			// the test binary is a program using this package run as a command
+			_, err = k.RunArgv("env", nestedDirEnv+"="+dir, os.Args[0], "-test.run=^TestNestedChild$")
+			is.NoErr(err)
+			is.NoErr(k.Close())
+			waitFor(t, func() bool {
+				_, err := os.Stat(filepath.Join(dir, "ran"))
+				return err == nil
+			})
+		})
+	}
+}
+
+// TestNestedChild is run by TestNested as a program using this package run by a helper.
+func TestNestedChild(t *testing.T) {
+	dir := os.Getenv(nestedDirEnv)
+	if dir == "" {
+		t.Skip("run by TestNested")
+	}
+	is := is.New(t)
+	// the program has its own helper
+	is.True(!DefaultKiller.conn.helper.shared)
+	is.NoErr(DefaultKiller.Err())
+	is.NoErr(os.WriteFile(filepath.Join(dir, "ran"), nil, 0o644))
+}
+
+func TestSplitWords(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	words := []string{"plain", "", "with space", "it's", `"double"`, `back\slash`, "$HOME", "tab\tand*glob"}
+	quoted, err := quote(words...)
+	is.NoErr(err)
+	split, err := splitWords(quoted)
+	is.NoErr(err)
+	is.Equal(split, words)
+
+	split, err = splitWords(`a\ b "c \"d\"" 'e'"f"`)
+	is.NoErr(err)
+	is.Equal(split, []string{"a b", `c "d"`, "ef"})
+
+	_, err = splitWords("'unterminated")
+	is.True(err != nil)
+}
@@ -0,0 +1,458 @@
+package onexit
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"al.essio.dev/pkg/shellescape"
+)
+
+const (
+	// time the helper has to acknowledge a command
+	ackTimeout = 5 * time.Second
+	// number of times in a row a helper exiting is respawned before waiting for the next command to try again
+	maxRespawns = 3
+)
+
+// conn is the connection to a helper process shared by a [Killer] and every Killer derived from it.
+type conn struct {
+	opts Options
+
+	mu sync.Mutex
+	// next id to queue a command with
+	seq int64
+	// commands queued and not cancelled by id, replayed if the helper has to be respawned
+	queued map[int64]string
+	helper *instance
+	// commands queued on disk if Options.JournalDir is set
+	journal *journal
+	// reason the helper is not healthy
+	err error
+	// program the helper runs the queued commands after once it exits, even if programs sharing the helper
+	// keep its input open
+	owner int
+	// prefix of ids telling apart the commands of programs sharing a helper
+	prefix string
+	// number of times the helper was respawned after exiting since it last acknowledged a command
+	respawns int
+	closed   bool
+}
+
+func newConn(opts Options) (*conn, error) {
+	c := &conn{opts: opts, queued: map[int64]string{}, owner: os.Getpid()}
+	if opts.JournalDir != "" {
+		var err error
+		if c.journal, err = openJournal(opts.JournalDir); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// sharedConn returns a conn queueing commands in the helper of the program that started this one through
+// the pipe inherited as fd, see [Killer.Share].
+func sharedConn(fd string) (*conn, error) {
+	n, err := strconv.Atoi(fd)
+	var st syscall.Stat_t
+	if err == nil {
+		err = syscall.Fstat(n, &st)
+	}
+	if err == nil && st.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+		err = errors.New("not a pipe")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("onexit: invalid %s %q: %w", helperFDEnv, fd, err)
+	}
+	// processes started by this program only share the helper if they are passed it too
+	syscall.CloseOnExec(n)
+	c, err := newConn(Options{})
+	if err != nil {
+		return nil, err
+	}
+	// the helper runs the commands once the program identified by the prefix exits
+	start, _ := processStart(os.Getpid())
+	c.prefix = fmt.Sprintf("%d-%d.", os.Getpid(), start)
+	c.helper = &instance{w: os.NewFile(uintptr(n), "onexit"), prefix: c.prefix, shared: true, waiters: map[int64]chan error{}}
+	return c, nil
+}
+
+// queue queues op with the rest of its line returning the id it was queued with.
+func (c *conn) queue(op operation, rest string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.seq
+	c.seq++
+	line := fmt.Sprintf("%s:%s%d %s", op, c.prefix, id, rest)
+	if err := c.sendRetry(id, line); err != nil {
+		return 0, fmt.Errorf("onexit: failed to queue: %w", err)
+	}
+	c.queued[id] = line
+	if c.journal != nil {
+		c.journal.record(line, c.queued)
+	}
+	return id, nil
+}
+
+func (c *conn) dequeue(id int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.queued[id]; !ok {
+		return nil
+	}
+	// a respawned helper won't be sent the command even if cancelling it fails
+	delete(c.queued, id)
+	line := fmt.Sprintf("%s:%s%d", opCancel, c.prefix, id)
+	if c.journal != nil {
+		c.journal.record(line, c.queued)
+	}
+	if err := c.sendRetry(id, line); err != nil {
+		return fmt.Errorf("onexit: failed to cancel: %w", err)
+	}
+	return nil
+}
+
+// run runs the commands ids that are still queued now, waiting for them to finish.
+func (c *conn) run(ids []int64) error {
+	c.mu.Lock()
+	var list []string
+	for _, id := range ids {
+		if _, ok := c.queued[id]; !ok {
+			continue
+		}
+		delete(c.queued, id)
+		list = append(list, c.prefix+strconv.FormatInt(id, 10))
+		// the commands are run by the time the journal is needed
+		if c.journal != nil {
+			c.journal.record(fmt.Sprintf("%s:%s%d", opCancel, c.prefix, id), c.queued)
+		}
+	}
+	if len(list) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	id := c.seq
+	c.seq++
+	var done <-chan error
+	err := errors.New("killer closed")
+	if !c.closed && c.err == nil {
+		done, err = c.helper.send(id, fmt.Sprintf("%s:%s%d %s", opRun, c.prefix, id, strings.Join(list, ",")))
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("onexit: failed to run: %w", err)
+	}
+	// commands may take a while so other commands are queued in the meantime
+	if err := <-done; err != nil {
+		return fmt.Errorf("onexit: failed to run: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.helper == nil {
+		return c.err
+	}
+	return c.helper.w.Close()
+}
+
+// share returns the pipe commands are written to so another program can queue commands in the helper.
+func (c *conn) share() (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errors.New("onexit: killer closed")
+	}
+	if c.err != nil {
+		if err := c.respawn(); err != nil {
+			return nil, fmt.Errorf("onexit: %w", err)
+		}
+	}
+	// a copy so respawning the helper can close its pipe while cmd is started
+	return dup(c.helper.w)
+}
+
+// dup returns a copy of f not inherited by processes started later.
+func dup(f *os.File) (*os.File, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var dupErr error
+	err = rc.Control(func(orig uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, dupErr = syscall.Dup(int(orig)); dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err = cmp.Or(err, dupErr); err != nil {
+		return nil, fmt.Errorf("onexit: failed to share helper: %w", err)
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+func (c *conn) health() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// sendRetry sends line to the helper, respawning it and trying again once if it isn't healthy.
+func (c *conn) sendRetry(id int64, line string) error {
+	if c.closed {
+		return errors.New("killer closed")
+	}
+	var err error
+	for range 2 {
+		if c.err != nil {
+			if err = c.respawn(); err != nil {
+				continue
+			}
+		}
+		if err = c.send(id, line); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// send writes line to the helper and waits for it to acknowledge id.
+//
+// If the helper doesn't acknowledge it in time it is killed to be respawned.
+func (c *conn) send(id int64, line string) error {
+	done, err := c.helper.send(id, line)
+	if err == nil {
+		select {
+		case err = <-done:
+		case <-time.After(ackTimeout):
+			err = errors.New("timed out waiting for acknowledgement")
+		}
+	}
+	if err != nil {
+		c.err = fmt.Errorf("helper unhealthy: %w", err)
+		c.helper.kill(c.err)
+		return err
+	}
+	c.respawns = 0
+	return nil
+}
+
+// respawn starts a new helper and queues every command queued in the previous one.
+//
+// A program that can no longer write to a shared helper falls back to its own.
+func (c *conn) respawn() error {
+	if c.helper != nil {
+		// a helper seeing its input closed would run every command
+		c.helper.kill(errors.New("helper respawned"))
+	}
+	if err := c.start(); err != nil {
+		c.err = err
+		return err
+	}
+	c.err = nil
+	ids := slices.Sorted(maps.Keys(c.queued))
+	for _, id := range ids {
+		if err := c.send(id, c.queued[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start starts a helper process.
+func (c *conn) start() error {
+	opts := c.opts
+	env := os.Environ()
+	start, _ := processStart(c.owner)
+	env = append(env, fmt.Sprintf("%s=%d %d", helperOwnerEnv, c.owner, start))
+	if c.journal != nil {
+		env = append(env, helperJournalEnv+"="+c.journal.path)
+	}
+	if opts.EventLog != "" {
+		env = append(env, helperEventsEnv+"="+opts.EventLog)
+	}
+	var p *exec.Cmd
+	switch opts.Helper {
+	case HelperExec:
+		path := opts.Path
+		if path == "" {
+			var err error
+			if path, err = os.Executable(); err != nil {
+				return fmt.Errorf("onexit: failed to find executable: %w", err)
+			}
+		}
+		p = exec.Command(path)
+		env = append(env, helperEnv+"=1", helperLogEnv+"="+opts.LogFile)
+	case HelperShell:
+		script := onexit
+		if opts.LogFile != "" {
+			script = strings.TrimSuffix(script, "\n")
+			script += "2>&1 | tee -a " + shellescape.Quote(opts.LogFile) + "\n"
+		}
+		p = exec.Command(cmp.Or(opts.Path, "/bin/bash"), "-c", script)
+	default:
+		return fmt.Errorf("onexit: unknown helper %d", opts.Helper)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("onexit: failed to open pipe: %w", err)
+	}
+	defer r.Close()
+	acks, ackW, err := os.Pipe()
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("onexit: failed to open pipe: %w", err)
+	}
+	defer ackW.Close()
+
+	p.Env = env
+	p.Stdin = r
+	// acknowledgements are written to fd 3
+	p.ExtraFiles = []*os.File{ackW}
+	// a nil writer is connected to /dev/null directly so the helper never writes to a pipe closed by
+	// this program exiting
+	if opts.Log != nil && opts.Log != io.Discard {
+		p.Stdout = opts.Log
+		p.Stderr = opts.Log
+	}
+	// keep the helper out of this program's process group so it isn't interrupted alongside it
+	p.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := p.Start(); err != nil {
+		_ = w.Close()
+		_ = acks.Close()
+		return fmt.Errorf("onexit: failed to start helper: %w", err)
+	}
+	c.helper = &instance{process: p.Process, w: w, prefix: c.prefix, waiters: map[int64]chan error{}}
+	go c.helper.readAcks(acks)
+	if c.journal != nil {
+		c.journal.startedHelper(p.Process.Pid, c.queued)
+	}
+	go c.monitor(p, c.helper)
+	return nil
+}
+
+// monitor waits for the helper p to exit, respawning it unless c was closed.
+func (c *conn) monitor(p *exec.Cmd, helper *instance) {
+	err := p.Wait()
+	if err == nil {
+		err = errors.New(p.ProcessState.String())
+	}
+	err = fmt.Errorf("helper exited: %w", err)
+	helper.fail(err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.helper != helper {
+		return
+	}
+	c.err = err
+	// a helper that keeps exiting is only retried when a command is next queued
+	if c.respawns < maxRespawns {
+		c.respawns++
+		_ = c.respawn()
+	}
+}
+
+// instance is a running helper process.
+type instance struct {
+	// nil if the helper is shared
+	process *os.Process
+	// pipe commands are written to
+	w *os.File
+	// prefix of the ids acknowledged to this program
+	prefix string
+	// acknowledgements of a shared helper are read by the program that started it so commands are assumed
+	// queued once written
+	shared bool
+
+	mu sync.Mutex
+	// channels waiting for the acknowledgement of an id
+	waiters map[int64]chan error
+	// reason no more acknowledgements will be read
+	err error
+}
+
+// send writes line to the helper returning a channel receiving once id is acknowledged.
+func (in *instance) send(id int64, line string) (<-chan error, error) {
+	done := make(chan error, 1)
+	in.mu.Lock()
+	if in.err != nil {
+		in.mu.Unlock()
+		return nil, in.err
+	}
+	in.waiters[id] = done
+	in.mu.Unlock()
+	if _, err := fmt.Fprintln(in.w, line); err != nil {
+		in.mu.Lock()
+		delete(in.waiters, id)
+		in.mu.Unlock()
+		return nil, err
+	}
+	if in.shared {
+		in.mu.Lock()
+		delete(in.waiters, id)
+		in.mu.Unlock()
+		done <- nil
+	}
+	return done, nil
+}
+
+// readAcks reads "ack:<id>" lines from acks until the helper exits.
+func (in *instance) readAcks(acks *os.File) {
+	defer acks.Close()
+	s := bufio.NewScanner(acks)
+	for s.Scan() {
+		id, err := strconv.ParseInt(strings.TrimPrefix(s.Text(), "ack:"+in.prefix), 10, 64)
+		// ids of programs sharing the helper aren't numbers
+		if err != nil {
+			continue
+		}
+		in.mu.Lock()
+		// acknowledgements that arrive too late have no waiter
+		if done, ok := in.waiters[id]; ok {
+			done <- nil
+			delete(in.waiters, id)
+		}
+		in.mu.Unlock()
+	}
+	in.fail(errors.New("helper closed its acknowledgements"))
+}
+
+// fail fails every waiter and future send with err.
+func (in *instance) fail(err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.err != nil {
+		return
+	}
+	in.err = err
+	for id, done := range in.waiters {
+		done <- err
+		delete(in.waiters, id)
+	}
+}
+
+// kill kills the helper without it running any commands, or stops using it if it is shared.
+func (in *instance) kill(err error) {
+	if in.process != nil {
+		_ = in.process.Kill()
+	}
+	_ = in.w.Close()
+	in.fail(err)
+}
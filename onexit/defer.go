@@ -0,0 +1,164 @@
+package onexit
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultDeferTimeout is the default of [DeferOptions.Timeout].
+const DefaultDeferTimeout = 10 * time.Second
+
+// DeferOptions configures the functions registered with [Defer], see [SetupDefer].
+type DeferOptions struct {
+	// Signals are the signals running the functions, SIGINT, SIGTERM and SIGHUP if nil.
+	//
+	// A program handling SIGHUP otherwise, such as with
+	// [github.com/matgreaves/run/logfile.File.ReopenOnSIGHUP] or by forwarding it with
+	// [github.com/matgreaves/run.Process.ForwardSignals], should leave it out.
+	Signals []os.Signal
+	// Timeout is the time the functions have in total to run before the program exits without waiting for
+	// the rest, DefaultDeferTimeout if zero.
+	Timeout time.Duration
+}
+
+type deferred struct {
+	id int64
+	fn func(context.Context)
+}
+
+var defers struct {
+	mu  sync.Mutex
+	seq int64
+	// functions in the order they were registered
+	fns  []deferred
+	opts DeferOptions
+	// receives opts.Signals once a function has been registered
+	signals chan os.Signal
+	exiting bool
+}
+
+// SetupDefer configures the functions registered with [Defer]. It returns an error once a function has been
+// registered, so call it first such as at the start of main.
+func SetupDefer(opts DeferOptions) error {
+	defers.mu.Lock()
+	defer defers.mu.Unlock()
+	if defers.signals != nil {
+		return errors.New("onexit: setup defer: functions already registered")
+	}
+	opts.Signals = slices.Clone(opts.Signals)
+	defers.opts = opts
+	return nil
+}
+
+// Defer registers fn to run in this program when it receives one of [DeferOptions.Signals], SIGINT, SIGTERM
+// or SIGHUP by default, or calls [Exit], for cleanup needing the state of the program such as flushing files
+// which a helper can't do. Functions run one at a time, most recently registered first like deferred
+// functions, and share a context cancelled after [DeferOptions.Timeout]. See [SetupDefer] to configure them.
+//
+// Once a function is registered the signals no longer take their default action: the program exits with 128
+// plus the signal after running the functions, or straight away if it receives another of the signals while
+// they run. Functions aren't run if the program exits any other way, so call [Exit] instead of [os.Exit].
+//
+// The signals are still delivered to channels passed to [signal.Notify], including by [signal.NotifyContext],
+// but the program exits without waiting for them to be handled. A program shutting down gracefully when its
+// context is cancelled should do so in a deferred function or leave the signal out of DeferOptions.Signals.
+//
+// cancel unregisters fn.
+func Defer(fn func(ctx context.Context)) (cancel func()) {
+	defers.mu.Lock()
+	defer defers.mu.Unlock()
+	if defers.signals == nil {
+		signals := defers.opts.Signals
+		if signals == nil {
+			signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+		}
+		defers.signals = make(chan os.Signal, 1)
+		signal.Notify(defers.signals, signals...)
+		go handleSignals(defers.signals)
+	}
+	id := defers.seq
+	defers.seq++
+	defers.fns = append(defers.fns, deferred{id: id, fn: fn})
+	return func() {
+		defers.mu.Lock()
+		defer defers.mu.Unlock()
+		defers.fns = slices.DeleteFunc(defers.fns, func(d deferred) bool { return d.id == id })
+	}
+}
+
+// Exit runs the functions registered with [Defer] then exits the program with code. Calls made while the
+// functions run never return.
+func Exit(code int) {
+	fns, timeout, ok := startExit()
+	if !ok {
+		select {}
+	}
+	runDeferred(fns, timeout)
+	os.Exit(code)
+}
+
+// handleSignals exits the program after running the functions registered with [Defer] when it receives a
+// signal, or straight away on a signal received while they run.
+func handleSignals(signals <-chan os.Signal) {
+	for sig := range signals {
+		code := 128 + int(sig.(syscall.Signal))
+		fns, timeout, ok := startExit()
+		if !ok {
+			os.Exit(code)
+		}
+		go func() {
+			runDeferred(fns, timeout)
+			os.Exit(code)
+		}()
+	}
+}
+
+// startExit takes the registered functions and the time they have to run unless the program is already
+// exiting.
+func startExit() ([]deferred, time.Duration, bool) {
+	defers.mu.Lock()
+	defer defers.mu.Unlock()
+	if defers.exiting {
+		return nil, 0, false
+	}
+	defers.exiting = true
+	fns := defers.fns
+	defers.fns = nil
+	return fns, cmp.Or(defers.opts.Timeout, DefaultDeferTimeout), true
+}
+
+// runDeferred runs fns last first until they have all returned or timeout has passed.
+func runDeferred(fns []deferred, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, d := range slices.Backward(fns) {
+			runDeferredFunc(ctx, d.fn)
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Fprintf(os.Stderr, "onexit: deferred functions still running after %s\n", timeout)
+	}
+}
+
+// runDeferredFunc runs fn, a panic only stops fn so the functions registered before it still run.
+func runDeferredFunc(ctx context.Context, fn func(context.Context)) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "onexit: deferred function panicked: %v\n", r)
+		}
+	}()
+	fn(ctx)
+}
@@ -0,0 +1,136 @@
+package onexit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// "<mode> <dir>" of TestDeferChild when run by TestDefer
+const deferEnv = "ONEXIT_TEST_DEFER"
+
+func TestDefer(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		signals []syscall.Signal
+		code    int
+		order   string
+	}{
+		{name: "signal", signals: []syscall.Signal{syscall.SIGTERM}, code: 128 + int(syscall.SIGTERM), order: "second\nfirst\n"},
+		{name: "hangup", signals: []syscall.Signal{syscall.SIGHUP}, code: 128 + int(syscall.SIGHUP), order: "second\nfirst\n"},
+		// SIGHUP keeps its default action when left out of the signals
+		{name: "hangup-ignored", signals: []syscall.Signal{syscall.SIGHUP}, code: -1},
+		// the second signal skips the function blocking the others
+		{name: "repeat", signals: []syscall.Signal{syscall.SIGINT, syscall.SIGINT}, code: 128 + int(syscall.SIGINT), order: "blocking\n"},
+		{name: "exit", code: 3, order: "second\npanic\nfirst\n"},
+		{name: "timeout", code: 3, order: "blocking\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			dir := t.TempDir()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestDeferChild$")
+			cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s %s", deferEnv, tc.name, dir))
+			cmd.Stderr = os.Stderr
+			stdout, err := cmd.StdoutPipe()
+			is.NoErr(err)
+			is.NoErr(cmd.Start())
+			defer cmd.Process.Kill()
+
+			// the child prints ready once its functions are registered
+			r := bufio.NewReader(stdout)
+			line, err := r.ReadString('\n')
+			is.NoErr(err)
+			is.Equal(line, "ready\n")
+			for i, sig := range tc.signals {
+				if i > 0 {
+					// the functions are running once the first signal is handled
+					waitFor(t, func() bool {
+						b, _ := os.ReadFile(filepath.Join(dir, "order"))
+						return len(b) > 0
+					})
+				}
+				is.NoErr(cmd.Process.Signal(sig))
+			}
+
+			start := time.Now()
+			err = cmd.Wait()
+			var exit *exec.ExitError
+			is.True(errors.As(err, &exit))
+			is.Equal(exit.ExitCode(), tc.code)
+			is.True(time.Since(start) < 5*time.Second)
+			b, err := os.ReadFile(filepath.Join(dir, "order"))
+			is.True(err == nil || errors.Is(err, os.ErrNotExist))
+			is.Equal(string(b), tc.order)
+		})
+	}
+}
+
+// TestDeferChild is run by TestDefer as a program deferring functions.
+func TestDeferChild(t *testing.T) {
+	var mode, dir string
+	if _, err := fmt.Sscan(os.Getenv(deferEnv), &mode, &dir); err != nil {
+		t.Skip("run by TestDefer")
+	}
+	record := func(name string) func(context.Context) {
+		return func(context.Context) {
+			f, err := os.OpenFile(filepath.Join(dir, "order"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintln(f, name)
+			_ = f.Close()
+		}
+	}
+
+	switch mode {
+	case "repeat", "timeout":
+		timeout := time.Hour
+		if mode == "timeout" {
+			timeout = 100 * time.Millisecond
+		}
+		if err := SetupDefer(DeferOptions{Timeout: timeout}); err != nil {
+			panic(err)
+		}
+		Defer(record("first"))
+		Defer(func(ctx context.Context) {
+			record("blocking")(ctx)
+			// ignores ctx
+			select {}
+		})
+	default:
+		if mode == "hangup-ignored" {
+			if err := SetupDefer(DeferOptions{Signals: []os.Signal{syscall.SIGINT, syscall.SIGTERM}}); err != nil {
+				panic(err)
+			}
+		}
+		Defer(record("first"))
+		if SetupDefer(DeferOptions{}) == nil {
+			panic("set up after registering a function")
+		}
+		if mode == "exit" {
+			Defer(func(context.Context) { panic("deferred") })
+			Defer(record("panic"))
+		}
+		Defer(record("second"))
+		cancel := Defer(record("cancelled"))
+		cancel()
+	}
+	fmt.Println("ready")
+	if mode == "exit" || mode == "timeout" {
+		Exit(3)
+	}
+	select {}
+}
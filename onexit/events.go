@@ -0,0 +1,172 @@
+package onexit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EventType is the kind of an [Event].
+type EventType string
+
+const (
+	// EventQueued is recorded when the helper queues a command.
+	EventQueued EventType = "queued"
+	// EventCancelled is recorded when a queued command is cancelled.
+	EventCancelled EventType = "cancelled"
+	// EventExecuted is recorded when a command ran successfully.
+	EventExecuted EventType = "executed"
+	// EventFailed is recorded when a command failed or timed out.
+	EventFailed EventType = "failed"
+)
+
+// StatusTimedOut is the [Event.Status] of a command that timed out, as with timeout(1).
+const StatusTimedOut = 124
+
+// Event is a line of the event log written by a helper, see [Options.EventLog].
+type Event struct {
+	// time the event was recorded
+	Time time.Time
+	Type EventType
+	// id of the command, prefixed by the pid of the program that queued it if the helper is shared
+	ID string
+	// kind of command such as "exit", "kill" or "rm"
+	Op string
+	// human readable description of the command: the shell command, the description of the process being
+	// killed or the quoted arguments of other commands
+	Desc string
+	// exit status of an executed or failed command. Failures of commands that aren't run as a process have a
+	// status of 1, and a command killed by a signal has a status of 128 plus the signal.
+	Status int
+	// time a command took to run
+	Duration time.Duration
+	// reason a command failed
+	Error string
+}
+
+// eventJSON is the encoding of an [Event] shared with onexit.sh.
+type eventJSON struct {
+	Time       time.Time `json:"time"`
+	Type       EventType `json:"type"`
+	ID         string    `json:"id"`
+	Op         string    `json:"op"`
+	Desc       string    `json:"desc"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error"`
+}
+
+// ReadEvents reads the events of the event log at path in the order they were recorded.
+//
+// A last line cut short by the helper being killed is ignored.
+func ReadEvents(path string) ([]Event, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	n := 0
+	for line := range bytes.Lines(b) {
+		n++
+		var e eventJSON
+		if err := json.Unmarshal(line, &e); err != nil {
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				break
+			}
+			return events, fmt.Errorf("onexit: invalid event on line %d of %s: %w", n, path, err)
+		}
+		events = append(events, Event{
+			Time:     e.Time,
+			Type:     e.Type,
+			ID:       e.ID,
+			Op:       e.Op,
+			Desc:     e.Desc,
+			Status:   e.Status,
+			Duration: time.Duration(e.DurationMs) * time.Millisecond,
+			Error:    e.Error,
+		})
+	}
+	return events, nil
+}
+
+// helperOutput is where a helper writes its logs and events.
+type helperOutput struct {
+	mu   sync.Mutex
+	logs io.Writer
+	// writer each event is written to as a line of JSON, nil if there is no event log
+	events io.Writer
+}
+
+func (o *helperOutput) logf(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, _ = fmt.Fprintf(o.logs, "onexit: "+format+"\n", args...)
+}
+
+// event records an event of typ for c, err is the reason c failed.
+func (o *helperOutput) event(typ EventType, c *helperCommand, status int, duration time.Duration, err error) {
+	if o.events == nil {
+		return
+	}
+	e := eventJSON{
+		Time:       time.Now(),
+		Type:       typ,
+		ID:         c.id,
+		Op:         string(c.op),
+		Desc:       c.desc(),
+		Status:     status,
+		DurationMs: duration.Milliseconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b, _ := json.Marshal(e)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// a single write so helpers sharing the log don't interleave events
+	_, _ = o.events.Write(append(b, '\n'))
+}
+
+// exitStatus returns the exit status of a command that failed with err as a shell would report it.
+func exitStatus(err error) int {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return 1
+	}
+	if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exit.ExitCode()
+}
+
+// desc returns the human readable description of c, see [Event.Desc].
+func (c *helperCommand) desc() string {
+	var n int
+	switch c.op {
+	case opKill:
+		// signal pid start desc
+		n = 3
+	case opTerm:
+		// signals timeout pid start desc
+		n = 4
+	default:
+		return c.data
+	}
+	fields := strings.SplitN(c.data, " ", n+1)
+	if len(fields) > n && fields[n] != "" {
+		return fields[n]
+	}
+	if len(fields) >= n {
+		// the pid
+		return fields[n-2]
+	}
+	return c.data
+}
@@ -0,0 +1,105 @@
+package onexit
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			fn := filepath.Join(t.TempDir(), "events.jsonl")
+			k, err := New(Options{Helper: helper, EventLog: fn})
+			is.NoErr(err)
+
+			sleep := exec.Command("sleep", "60")
+			is.NoErr(sleep.Start())
+			defer sleep.Process.Kill()
+			go sleep.Wait()
+
+			start := time.Now()
+			_, err = k.OnExit(`echo "quoted"`)
+			is.NoErr(err)
+			_, err = k.OnExit("exit 3")
+			is.NoErr(err)
+			cancel, err := k.OnExit("echo cancelled")
+			is.NoErr(err)
+			is.NoErr(cancel())
+			_, err = k.With(Timeout(100 * time.Millisecond)).OnExit("sleep 5")
+			is.NoErr(err)
+			_, err = k.Terminate("sleeper", sleep.Process.Pid, 15, time.Second)
+			is.NoErr(err)
+			is.NoErr(k.Close())
+
+			var events []Event
+			waitFor(t, func() bool {
+				events, err = ReadEvents(fn)
+				return err == nil && len(events) == 10
+			})
+
+			byType := map[EventType][]Event{}
+			for _, e := range events {
+				is.True(!e.Time.Before(start.Truncate(time.Millisecond)))
+				byType[e.Type] = append(byType[e.Type], e)
+			}
+			is.Equal(len(byType[EventQueued]), 5)
+			is.Equal(len(byType[EventCancelled]), 1)
+			is.Equal(byType[EventCancelled][0].Desc, "echo cancelled")
+
+			// commands run in reverse, killing processes first
+			executed := byType[EventExecuted]
+			is.Equal(len(executed), 2)
+			is.Equal(executed[0].Op, "term")
+			is.Equal(executed[0].Desc, "sleeper")
+			is.Equal(executed[1].Desc, `echo "quoted"`)
+
+			failed := byType[EventFailed]
+			is.Equal(len(failed), 2)
+			is.Equal(failed[0].Desc, "sleep 5")
+			is.Equal(failed[0].Status, StatusTimedOut)
+			is.True(failed[0].Duration >= 100*time.Millisecond)
+			is.Equal(failed[1].Desc, "exit 3")
+			is.Equal(failed[1].Status, 3)
+			is.Equal(failed[1].Error, "exit status 3")
+		})
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	fn := filepath.Join(t.TempDir(), "events.jsonl")
+	valid := `{"time":"2025-01-02T03:04:05.123456+00:00","type":"failed","id":"1","op":"exit","desc":"false","status":1,"duration_ms":15,"error":"exit status 1"}` + "\n"
+
+	// a helper killed while writing an event leaves the last line cut short
+	is.NoErr(os.WriteFile(fn, []byte(valid+valid[:20]), 0o644))
+	events, err := ReadEvents(fn)
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.True(events[0].Time.Equal(time.Date(2025, 1, 2, 3, 4, 5, 123456000, time.UTC)))
+	events[0].Time = time.Time{}
+	is.Equal(events, []Event{{
+		Type:     EventFailed,
+		ID:       "1",
+		Op:       "exit",
+		Desc:     "false",
+		Status:   1,
+		Duration: 15 * time.Millisecond,
+		Error:    "exit status 1",
+	}})
+
+	is.NoErr(os.WriteFile(fn, []byte(valid[:20]+"\n"+valid), 0o644))
+	_, err = ReadEvents(fn)
+	is.True(err != nil)
+}
@@ -0,0 +1,435 @@
+package onexit
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// set in the environment of a [HelperExec] helper to run it instead of the program
+	helperEnv = "ONEXIT_HELPER"
+	// file a [HelperExec] helper appends its logs to
+	helperLogEnv = "ONEXIT_HELPER_LOG"
+	// journal a helper removes once it has run its commands
+	helperJournalEnv = "ONEXIT_HELPER_JOURNAL"
+	// file a helper appends its events to, see Options.EventLog
+	helperEventsEnv = "ONEXIT_HELPER_EVENTS"
+	// "pid start" of the program that started the helper, see conn.owner
+	helperOwnerEnv = "ONEXIT_HELPER_OWNER"
+	// fd of the pipe to a helper shared by the program that started this one, see [Killer.Share]
+	helperFDEnv = "ONEXIT_HELPER_FD"
+	// interval a helper checks whether the program that started it has exited
+	ownerPoll = 200 * time.Millisecond
+)
+
+// helperMain runs this program as a [HelperExec] helper returning its exit code.
+func helperMain() int {
+	// the commands run must not inherit the configuration of the helper, a program using this package would
+	// run as a helper or share this one
+	env := map[string]string{}
+	for _, k := range []string{helperEnv, helperLogEnv, helperJournalEnv, helperEventsEnv, helperOwnerEnv, helperFDEnv} {
+		env[k] = os.Getenv(k)
+		_ = os.Unsetenv(k)
+	}
+
+	// logs may be written to a pipe read by the program which is gone once it has exited
+	signal.Ignore(syscall.SIGPIPE)
+	var logs io.Writer = os.Stdout
+	if fn := env[helperLogEnv]; fn != "" {
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "onexit: failed to open log file: %v\n", err)
+		} else {
+			logs = io.MultiWriter(os.Stdout, f)
+		}
+	}
+	out := &helperOutput{logs: logs}
+	if fn := env[helperEventsEnv]; fn != "" {
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			out.logf("failed to open event log: %v", err)
+		} else {
+			out.events = f
+		}
+	}
+	runHelper(os.Stdin, os.NewFile(3, "acks"), out, watchOwner(env[helperOwnerEnv]))
+	if fn := env[helperJournalEnv]; fn != "" {
+		_ = os.Remove(fn)
+	}
+	return 0
+}
+
+// watchOwner returns a channel closed once the program identified by owner, "pid start", has exited or nil
+// if owner is empty.
+func watchOwner(owner string) <-chan struct{} {
+	var pid int
+	var start uint64
+	if _, err := fmt.Sscan(owner, &pid, &start); err != nil {
+		return nil
+	}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for alive(pid, start) {
+			time.Sleep(ownerPoll)
+		}
+	}()
+	return exited
+}
+
+// helperCommand is a command queued in a helper.
+type helperCommand struct {
+	op       operation
+	id       string
+	priority int
+	timeout  time.Duration
+	parallel bool
+	data     string
+}
+
+// parseCommand parses the payload of an operation queueing a command, "id priority timeout parallel data".
+func parseCommand(op operation, payload string) (*helperCommand, error) {
+	fields := strings.SplitN(payload, " ", 5)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("invalid %s: %q", op, payload)
+	}
+	c := &helperCommand{op: op, id: fields[0], data: fields[4]}
+	var err error
+	if c.priority, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, fmt.Errorf("invalid priority: %w", err)
+	}
+	timeout, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %w", err)
+	}
+	c.timeout = time.Duration(timeout) * time.Millisecond
+	c.parallel = fields[3] == "1"
+	return c, nil
+}
+
+// watchSharer sends prefix, "<pid>-<start>", on exited once the program sharing the helper it identifies
+// has exited unless done is closed first.
+func watchSharer(prefix string, exited chan<- string, done <-chan struct{}) {
+	var pid int
+	var start uint64
+	if _, err := fmt.Sscanf(prefix, "%d-%d", &pid, &start); err != nil {
+		return
+	}
+	for alive(pid, start) {
+		select {
+		case <-done:
+			return
+		case <-time.After(ownerPoll):
+		}
+	}
+	select {
+	case exited <- prefix:
+	case <-done:
+	}
+}
+
+// runHelper queues the commands read from r, acknowledging each on acks, until r is closed or owner is
+// closed then runs them. Programs sharing the helper keep r open after the program that started it exits,
+// their commands, with ids prefixed "<pid>-<start>.", run once they exit. It mirrors onexit.sh.
+func runHelper(r io.Reader, acks io.Writer, out *helperOutput, owner <-chan struct{}) {
+	logf := out.logf
+	var ackMu sync.Mutex
+	ack := func(id string) {
+		ackMu.Lock()
+		defer ackMu.Unlock()
+		// the helper may outlive whoever reads acknowledgements
+		_, _ = fmt.Fprintf(acks, "ack:%s\n", id)
+	}
+	logf("running")
+
+	// commands in the order they were queued
+	var cmds []*helperCommand
+	// commands run early by a scope or because the program sharing the helper that queued them exited
+	var running sync.WaitGroup
+	// programs sharing the helper by the prefix of their ids
+	sharers := map[string]bool{}
+	sharerExited := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+read:
+	for {
+		var line string
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				logf("stdin closed - running commands")
+				break read
+			}
+			line = l
+		case <-owner:
+			logf("owner exited - running commands")
+			break read
+		case prefix := <-sharerExited:
+			delete(sharers, prefix)
+			var run []*helperCommand
+			cmds = slices.DeleteFunc(cmds, func(c *helperCommand) bool {
+				if strings.HasPrefix(c.id, prefix+".") {
+					run = append(run, c)
+					return true
+				}
+				return false
+			})
+			logf("%s exited - running %d commands", prefix, len(run))
+			running.Go(func() { runAll(run, out) })
+			continue
+		}
+		op, payload, _ := strings.Cut(line, ":")
+		var id string
+		switch operation(op) {
+		case opExit, opKill, opTerm, opRm, opUmount, opArgv, opWrite:
+			cmd, err := parseCommand(operation(op), payload)
+			if err != nil {
+				logf("invalid command: %s: %v", line, err)
+				continue
+			}
+			logf("queued %s: %s", cmd.id, cmd.data)
+			out.event(EventQueued, cmd, 0, 0, nil)
+			cmds = append(cmds, cmd)
+			id = cmd.id
+			if prefix, _, ok := strings.Cut(id, "."); ok && !sharers[prefix] {
+				sharers[prefix] = true
+				go watchSharer(prefix, sharerExited, done)
+			}
+		case opHelper:
+			// only found in journals
+			continue
+		case opCancel:
+			id = payload
+			i := slices.IndexFunc(cmds, func(c *helperCommand) bool { return c.id == id })
+			if i >= 0 {
+				logf("cancelling %s: %s", id, cmds[i].data)
+				out.event(EventCancelled, cmds[i], 0, 0, nil)
+				cmds = slices.Delete(cmds, i, i+1)
+			}
+		case opRun:
+			// id ids where ids are comma separated, acknowledged once the commands have run
+			var list string
+			id, list, _ = strings.Cut(payload, " ")
+			ids := strings.Split(list, ",")
+			var run []*helperCommand
+			cmds = slices.DeleteFunc(cmds, func(c *helperCommand) bool {
+				if slices.Contains(ids, c.id) {
+					run = append(run, c)
+					return true
+				}
+				return false
+			})
+			logf("running %d commands of %s", len(run), id)
+			running.Go(func() {
+				runAll(run, out)
+				ack(id)
+			})
+			continue
+		default:
+			logf("invalid command: %s", line)
+			continue
+		}
+		ack(id)
+	}
+
+	runAll(cmds, out)
+	running.Wait()
+}
+
+// runAll runs cmds, given in the order they were queued, highest priority first then last queued first.
+// Commands marked parallel run alongside the rest of their priority.
+func runAll(cmds []*helperCommand, out *helperOutput) {
+	cmds = slices.Clone(cmds)
+	slices.Reverse(cmds)
+	slices.SortStableFunc(cmds, func(a, b *helperCommand) int { return cmp.Compare(b.priority, a.priority) })
+	for level := range chunkBy(cmds, func(c *helperCommand) int { return c.priority }) {
+		var parallel sync.WaitGroup
+		for _, cmd := range level {
+			if cmd.parallel {
+				parallel.Go(func() { cmd.runLogged(out) })
+			}
+		}
+		for _, cmd := range level {
+			if !cmd.parallel {
+				cmd.runLogged(out)
+			}
+		}
+		parallel.Wait()
+	}
+}
+
+// chunkBy returns the runs of consecutive elements of s with the same key.
+func chunkBy[E any, K comparable](s []E, key func(E) K) func(func([]E) bool) {
+	return func(yield func([]E) bool) {
+		for start := 0; start < len(s); {
+			end := start + 1
+			for end < len(s) && key(s[end]) == key(s[start]) {
+				end++
+			}
+			if !yield(s[start:end]) {
+				return
+			}
+			start = end
+		}
+	}
+}
+
+// runLogged runs c logging it and recording whether it failed.
+func (c *helperCommand) runLogged(out *helperOutput) {
+	out.logf("> %s", c.data)
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- c.run(ctx, out.logs) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			out.logf("command failed: %s: %v", c.data, err)
+			out.event(EventFailed, c, exitStatus(err), time.Since(start), err)
+			return
+		}
+		out.event(EventExecuted, c, 0, time.Since(start), nil)
+	case <-ctx.Done():
+		out.logf("command timed out after %dms: %s", c.timeout.Milliseconds(), c.data)
+		err := fmt.Errorf("timed out after %dms", c.timeout.Milliseconds())
+		out.event(EventFailed, c, StatusTimedOut, time.Since(start), err)
+	}
+}
+
+func (c *helperCommand) run(ctx context.Context, logs io.Writer) error {
+	switch c.op {
+	case opKill, opTerm:
+		// kill: signal pid start desc
+		// term: signals timeout pid start desc
+		n := 3
+		if c.op == opTerm {
+			n = 4
+		}
+		fields := strings.SplitN(c.data, " ", n+1)
+		if len(fields) < n {
+			return fmt.Errorf("invalid %s: %q", c.op, c.data)
+		}
+		var sigs []syscall.Signal
+		for sig := range strings.SplitSeq(fields[0], ",") {
+			n, err := strconv.Atoi(sig)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %q: %w", c.op, c.data, err)
+			}
+			sigs = append(sigs, syscall.Signal(n))
+		}
+		ints := make([]int64, n)
+		for i := 1; i < n; i++ {
+			var err error
+			if ints[i], err = strconv.ParseInt(fields[i], 10, 64); err != nil {
+				return fmt.Errorf("invalid %s: %q: %w", c.op, c.data, err)
+			}
+		}
+		pid, start := int(ints[n-2]), uint64(ints[n-1])
+		desc := strconv.Itoa(pid)
+		if len(fields) > n {
+			desc = fields[n]
+		}
+		if reused(pid, start) {
+			_, _ = fmt.Fprintf(logs, "onexit: %s already exited, pid %d was reused\n", desc, pid)
+			return nil
+		}
+		if c.op == opKill {
+			_, _ = fmt.Fprintf(logs, "killing %s\n", desc)
+			return syscall.Kill(pid, sigs[0])
+		}
+		return terminate(logs, desc, pid, sigs, time.Duration(ints[1])*time.Millisecond)
+	case opRm, opUmount, opArgv, opWrite:
+		words, err := splitWords(c.data)
+		if err != nil {
+			return err
+		}
+		// argv takes any number of words
+		n := map[operation]int{opRm: 1, opUmount: 1, opWrite: 2}[c.op]
+		if len(words) == 0 || (n > 0 && len(words) != n) {
+			return fmt.Errorf("invalid %s: %q", c.op, c.data)
+		}
+		switch c.op {
+		case opRm:
+			if words[0] == "" || words[0] == "/" {
+				return fmt.Errorf("refusing to remove %q", words[0])
+			}
+			return os.RemoveAll(words[0])
+		case opUmount:
+			return syscall.Unmount(words[0], 0)
+		case opWrite:
+			f, err := os.OpenFile(words[0], os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteString(words[1])
+			return errors.Join(err, f.Close())
+		}
+		return c.exec(ctx, logs, exec.CommandContext(ctx, words[0], words[1:]...))
+	default:
+		return c.exec(ctx, logs, exec.CommandContext(ctx, "/bin/sh", "-c", c.data))
+	}
+}
+
+// exec runs cmd killing anything it started if ctx is done.
+func (c *helperCommand) exec(ctx context.Context, logs io.Writer, cmd *exec.Cmd) error {
+	cmd.Stdout, cmd.Stderr = logs, logs
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	return cmd.Run()
+}
+
+// terminatePoll is the interval terminate checks whether a process has exited.
+const terminatePoll = 50 * time.Millisecond
+
+// terminate sends each of sigs to pid in turn until it no longer exists, waiting up to timeout after each,
+// as [Killer.Terminate] and [Killer.KillGroup].
+func terminate(logs io.Writer, desc string, pid int, sigs []syscall.Signal, timeout time.Duration) error {
+	_, _ = fmt.Fprintf(logs, "terminating %s\n", desc)
+	start := time.Now()
+	for i, sig := range sigs {
+		if i > 0 {
+			_, _ = fmt.Fprintf(logs, "onexit: %s still running after %dms, sending signal %d\n", desc, timeout.Milliseconds(), sig)
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			return err
+		}
+		if i == len(sigs)-1 {
+			return nil
+		}
+		// signal 0 only checks whether the process or any member of the group exists
+		for sent := time.Now(); syscall.Kill(pid, 0) == nil && time.Since(sent) < timeout; {
+			time.Sleep(terminatePoll)
+		}
+		if syscall.Kill(pid, 0) != nil {
+			_, _ = fmt.Fprintf(logs, "onexit: %s exited after %dms\n", desc, time.Since(start).Milliseconds())
+			return nil
+		}
+	}
+	return nil
+}
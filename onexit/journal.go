@@ -0,0 +1,197 @@
+package onexit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// journalSlack is the number of lines a journal may hold beyond twice the number of queued commands before
+// it is rewritten with only the queued commands.
+const journalSlack = 64
+
+// journal records the commands queued in a helper on disk so they can be run by [Reap] if both this program
+// and the helper are killed.
+//
+// A journal holds the lines sent to the helper followed by "helper:<pid> <start>" lines identifying the
+// helper running them, and is named after the program that owns it "<pid>-<start>.journal". The helper
+// removes it once it has run the commands.
+type journal struct {
+	path string
+	f    *os.File
+	// lines in f and the most recent helper line
+	lines  int
+	helper string
+}
+
+func openJournal(dir string) (*journal, error) {
+	start, err := processStart(os.Getpid())
+	if err != nil {
+		return nil, fmt.Errorf("onexit: failed to open journal: %w", err)
+	}
+	// the commands in journals are run by Reap so no other user may add any
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("onexit: failed to open journal: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%d.journal", os.Getpid(), start))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("onexit: failed to open journal: %w", err)
+	}
+	return &journal{path: path, f: f}, nil
+}
+
+// startedHelper records the helper pid is running the commands.
+func (j *journal) startedHelper(pid int, queued map[int64]string) {
+	start, _ := processStart(pid)
+	j.helper = fmt.Sprintf("%s:%d %d", opHelper, pid, start)
+	j.record(j.helper, queued)
+}
+
+// record appends line to the journal, rewriting it with only the commands in queued once most of the
+// journal has been cancelled.
+//
+// The journal is a last resort so failing to write it is ignored.
+func (j *journal) record(line string, queued map[int64]string) {
+	if j.lines < 2*len(queued)+journalSlack {
+		j.lines++
+		_, _ = fmt.Fprintln(j.f, line)
+		return
+	}
+
+	// replace the journal so it's never seen partially written
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".journal-*")
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(tmp)
+	for _, id := range slices.Sorted(maps.Keys(queued)) {
+		fmt.Fprintln(w, queued[id])
+	}
+	fmt.Fprintln(w, j.helper)
+	if err := errors.Join(w.Flush(), tmp.Chmod(0o600), os.Rename(tmp.Name(), j.path)); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	_ = j.f.Close()
+	j.f, j.lines = tmp, len(queued)+1
+}
+
+// Reap runs the commands in the journals in dir left behind by programs and helpers that were killed, see
+// [Options.JournalDir]. It is typically called when a program starts to clean up after previous runs.
+//
+// Journals of programs that are still running, or whose helper is still running, are left alone. So are
+// journals that could have been written by another user: anything but a regular file owned by this user and
+// not writable by others.
+func Reap(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("onexit: reap: %w", err)
+	}
+	var errs []error
+	for _, e := range entries {
+		owner, ok := strings.CutSuffix(e.Name(), ".journal")
+		if !ok || running(owner) {
+			continue
+		}
+		if info, err := e.Info(); err != nil || !trusted(info) {
+			continue
+		}
+		if err := reap(filepath.Join(dir, e.Name())); err != nil {
+			errs = append(errs, fmt.Errorf("onexit: reap %s: %w", e.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reap runs the commands in the journal path unless its helper is still running.
+func reap(path string) error {
+	f, err := openTrusted(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// reaped or removed by its helper in the meantime
+		return nil
+	} else if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	var helper string
+	for line := range strings.Lines(string(b)) {
+		if id, ok := strings.CutPrefix(strings.TrimSpace(line), string(opHelper)+":"); ok {
+			helper = strings.Replace(id, " ", "-", 1)
+		}
+	}
+	if helper != "" && running(helper) {
+		return nil
+	}
+
+	// claim the journal so it isn't run by several programs reaping at once
+	claimed := path + ".reaping"
+	if err := os.Rename(path, claimed); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// checked again in case the journal was replaced before being claimed
+	f, err = openTrusted(claimed)
+	if err != nil {
+		return err
+	}
+	runHelper(f, io.Discard, &helperOutput{logs: io.Discard}, nil)
+	_ = f.Close()
+	return os.Remove(claimed)
+}
+
+// openTrusted opens the journal path for reading if it is trusted, see trusted.
+func openTrusted(path string) (*os.File, error) {
+	// a symlink or fifo put in place of the journal is neither followed nor blocks opening
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !trusted(info) {
+		err = errors.New("journal may have been written by another user")
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// trusted reports whether the journal described by info can only have been written by this user: it is a
+// regular file owned by this user and not writable by its group or others.
+func trusted(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && info.Mode().Perm()&0o022 == 0 && int(st.Uid) == os.Getuid()
+}
+
+// running reports whether the process identified by "<pid>-<start>" is still running.
+func running(id string) bool {
+	pid, start, ok := strings.Cut(id, "-")
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(pid)
+	if err != nil {
+		return false
+	}
+	curr, err := processStart(n)
+	return err == nil && strconv.FormatUint(curr, 10) == start
+}
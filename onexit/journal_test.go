@@ -0,0 +1,119 @@
+package onexit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			dir := t.TempDir()
+			k, err := New(Options{Helper: helper, JournalDir: filepath.Join(dir, "journals")})
+			is.NoErr(err)
+			_, err = k.OnExitF("touch %s/queued", dir)
+			is.NoErr(err)
+			// enough to compact the journal
+			for range 2 * journalSlack {
+				cancel, err := k.OnExit("false")
+				is.NoErr(err)
+				is.NoErr(cancel())
+			}
+
+			path := k.conn.journal.path
+			b, err := os.ReadFile(path)
+			is.NoErr(err)
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			is.True(len(lines) < journalSlack+2)
+			is.True(strings.HasSuffix(lines[0], "touch "+dir+"/queued"))
+			is.True(strings.Contains(string(b), fmt.Sprintf("\nhelper:%d ", k.conn.helper.process.Pid)))
+
+			is.NoErr(k.Close())
+			waitFor(t, func() bool {
+				_, err := os.Stat(path)
+				return errors.Is(err, os.ErrNotExist)
+			})
+			_, err = os.Stat(filepath.Join(dir, "queued"))
+			is.NoErr(err)
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	dir := t.TempDir()
+	journals := filepath.Join(dir, "journals")
+	is.NoErr(os.Mkdir(journals, 0o755))
+
+	exited := exec.Command("true")
+	is.NoErr(exited.Run())
+	dead := filepath.Join(journals, fmt.Sprintf("%d-1.journal", exited.Process.Pid))
+	is.NoErr(os.WriteFile(dead, fmt.Appendf(nil, `exit:0 0 0 0 touch %[1]s/first
+exit:1 0 0 0 touch %[1]s/cancelled
+exit:2 0 0 0 [ -e %[1]s/first ] || touch %[1]s/second
+cancel:1
+helper:%[2]d 1
+`, dir, exited.Process.Pid), 0o644))
+
+	start, err := processStart(os.Getpid())
+	is.NoErr(err)
+	alive := filepath.Join(journals, fmt.Sprintf("%d-%d.journal", os.Getpid(), start))
+	is.NoErr(os.WriteFile(alive, fmt.Appendf(nil, "exit:0 0 0 0 touch %s/alive\n", dir), 0o644))
+
+	is.NoErr(Reap(journals))
+	for fn, exists := range map[string]bool{"first": true, "second": true, "cancelled": false, "alive": false} {
+		_, err := os.Stat(filepath.Join(dir, fn))
+		is.Equal(err == nil, exists) // reaped commands
+	}
+	_, err = os.Stat(dead)
+	is.True(errors.Is(err, os.ErrNotExist))
+	_, err = os.Stat(alive)
+	is.NoErr(err)
+	is.NoErr(Reap(filepath.Join(dir, "missing")))
+
+	t.Run("untrusted", func(t *testing.T) {
+		t.Parallel()
+
+		is := is.New(t)
+		dir := t.TempDir()
+		journals := filepath.Join(dir, "journals")
+		is.NoErr(os.Mkdir(journals, 0o755))
+		journal := func(name string, perm os.FileMode) string {
+			fn := filepath.Join(journals, fmt.Sprintf("%d-1%s.journal", exited.Process.Pid, name))
+			is.NoErr(os.WriteFile(fn, fmt.Appendf(nil, "exit:0 0 0 0 touch %s/%s\n", dir, name), perm))
+			is.NoErr(os.Chmod(fn, perm))
+			return fn
+		}
+
+		journal("writable", 0o622)
+		foreign := journal("foreign", 0o600)
+		if os.Getuid() == 0 {
+			is.NoErr(os.Chown(foreign, 65534, 65534))
+		} else {
+			is.NoErr(os.Remove(foreign))
+		}
+		target := filepath.Join(dir, "target.journal")
+		is.NoErr(os.WriteFile(target, fmt.Appendf(nil, "exit:0 0 0 0 touch %s/symlink\n", dir), 0o600))
+		is.NoErr(os.Symlink(target, filepath.Join(journals, fmt.Sprintf("%d-1symlink.journal", exited.Process.Pid))))
+
+		is.NoErr(Reap(journals))
+		for _, fn := range []string{"writable", "foreign", "symlink"} {
+			_, err := os.Stat(filepath.Join(dir, fn))
+			is.True(errors.Is(err, os.ErrNotExist)) // untrusted journal reaped
+		}
+	})
+}
@@ -10,28 +10,46 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"syscall"
-
-	"al.essio.dev/pkg/shellescape"
+	"time"
 )
 
 func init() {
-	var err error
-	DefaultKiller, err = NewKiller(io.Discard, "/dev/null")
-	if err != nil {
-		panic(err)
+	// the helper re-executes this binary so takes over before main runs. The init functions of the packages
+	// this one doesn't depend on may already have run, so they mustn't have side effects a helper can't have
+	// such as starting processes.
+	if os.Getenv(helperEnv) != "" {
+		os.Exit(helperMain())
 	}
+	// a program started by one sharing its helper queues commands there, see Killer.Share
+	if fd := os.Getenv(helperFDEnv); fd != "" {
+		// programs started by this one only share the helper if they are passed it too
+		_ = os.Unsetenv(helperFDEnv)
+		if c, err := sharedConn(fd); err == nil {
+			DefaultKiller = &Killer{conn: c, scope: newScope(nil)}
+			return
+		}
+	}
+	c, _ := newConn(Options{EventLog: os.Getenv(EventLogEnv)})
+	// queueing retries starting the helper
+	c.err = c.start()
+	DefaultKiller = &Killer{conn: c, scope: newScope(nil)}
 }
 
 // DefaultKiller is the Killer instance used by the global [Kill], [OnExit], and [OnExitF] methods.
 //
-// By default this is a Killer that writes logs to io.Discard. Replace this with a killer from [NewKiller]
-// for more customisable options.
+// By default this is a Killer using a [HelperExec] helper that discards its logs, or the helper of the program
+// that started this one if it was shared with [Killer.Share]. Replace this with a killer from [New] for more
+// customisable options. Its helper records events in the file named by the [EventLogEnv] environment
+// variable if set, see [Options.EventLog].
 var DefaultKiller *Killer
 
+// EventLogEnv is the environment variable naming the event log of the helper of [DefaultKiller], useful to
+// find out whether the cleanup of a program run in CI ran and what it returned.
+const EventLogEnv = "ONEXIT_EVENT_LOG"
+
 //go:embed onexit.sh
 var onexit string
 
@@ -39,9 +57,49 @@ type operation string
 
 const (
 	opExit   operation = "exit"
+	opKill   operation = "kill"
+	opTerm   operation = "term"
+	opRm     operation = "rm"
+	opUmount operation = "umount"
+	opArgv   operation = "argv"
+	opWrite  operation = "write"
 	opCancel operation = "cancel"
+	// runs queued commands now, see Killer.Flush
+	opRun operation = "run"
+	// identifies the helper in a journal
+	opHelper operation = "helper"
+)
+
+// Helper is the kind of process commands are queued in to run when this program exits.
+type Helper int
+
+const (
+	// HelperExec re-executes the binary of this program as the helper. It needs nothing installed besides the
+	// program itself so works in minimal and distroless images, though commands queued with [Killer.OnExit]
+	// still need /bin/sh.
+	HelperExec Helper = iota
+	// HelperShell runs the embedded onexit.sh with bash.
+	HelperShell
 )
 
+// Options configure a [Killer] created with [New].
+type Options struct {
+	// kind of helper process, defaults to HelperExec.
+	Helper Helper
+	// path to the helper executable. Defaults to this program for HelperExec and /bin/bash for HelperShell.
+	Path string
+	// writer the logs of the helper are written to while this program is running. Defaults to discarding them.
+	Log io.Writer
+	// file the logs of the helper are appended to, including those written after this program has exited.
+	LogFile string
+	// directory to journal the queued commands in so they can be run by [Reap] if both this program and the
+	// helper are killed. It is created only accessible by this user if it doesn't exist.
+	JournalDir string
+	// file the helper appends an [Event] to as a line of JSON whenever a command is queued, cancelled or run,
+	// see [ReadEvents]. Programs sharing the helper record their events there too.
+	EventLog string
+}
+
 // Killer makes sure that commands that are supposed to run to clean up resources
 // are executed regardless of how cleanly the calling program ends.
 //
@@ -52,12 +110,57 @@ const (
 // the parent process closes and needing to handle abrupt exits to our program such as SIGKILL
 // which interfere with graceful cleanup.
 type Killer struct {
-	w   *os.File
-	seq atomic.Int64
-	mu  sync.Mutex
-	// filepath to external log file script logs are tee'd to. Defaults to /dev/null
-	// but can be useful for debugging.
-	extLogs string
+	conn *conn
+	opts options
+	// commands queued by k or a Killer derived from it, see [Killer.Scope]
+	scope *scope
+}
+
+const (
+	// PriorityKill is the default priority of commands killing processes, so they run before commands with
+	// the default priority of 0 such as those removing the directories the processes were using.
+	PriorityKill = 10
+	// PriorityUnmount is the default priority of [Killer.Unmount], after processes using the mount are
+	// killed and before the mount point is removed.
+	PriorityUnmount = 5
+)
+
+// Option configures commands queued by a [Killer], see [Killer.With].
+type Option func(*options)
+
+type options struct {
+	priority *int
+	timeout  time.Duration
+	parallel bool
+}
+
+// Priority sets the priority of commands. Commands with a higher priority run first.
+//
+// By default commands have a priority of 0, or [PriorityKill] for those killing processes and
+// [PriorityUnmount] for [Killer.Unmount], and commands
+// with the same priority run in the reverse order they were queued like deferred functions.
+func Priority(priority int) Option {
+	return func(o *options) { o.priority = &priority }
+}
+
+// Timeout sets the time commands have to finish before the helper moves on, killing them if possible.
+// By default commands have no timeout.
+func Timeout(timeout time.Duration) Option {
+	return func(o *options) { o.timeout = timeout }
+}
+
+// Parallel runs commands concurrently with the other commands of the same priority.
+func Parallel() Option {
+	return func(o *options) { o.parallel = true }
+}
+
+// With returns a Killer sharing the helper and scope of k that queues commands configured by opts.
+func (k *Killer) With(opts ...Option) *Killer {
+	with := *k
+	for _, opt := range opts {
+		opt(&with.opts)
+	}
+	return &with
 }
 
 // Kill kills the process identified by pid with human readable description desc.
@@ -67,20 +170,87 @@ type Killer struct {
 // A cancel function is returned that will cancel this killing if the process has otherwise been gracefully
 // terminated.
 func (k *Killer) Kill(desc string, pid int, sig ...syscall.Signal) (cancel func() error, _ error) {
-	desc = shellescape.Quote(desc)
 	signal := syscall.SIGINT
 	if len(sig) > 0 {
 		signal = sig[0]
 	}
-	return OnExitF("echo killing %s; kill -%d %d", desc, signal, pid)
+	// newlines separate operations
+	desc = strings.ReplaceAll(desc, "\n", " ")
+	// the helper may run long after pid has exited and been reused
+	start, _ := processStart(pid)
+	return k.queue(opKill, PriorityKill, fmt.Sprintf("%d %d %d %s", signal, pid, start, desc))
+}
+
+// Terminate stops the process identified by pid with human readable description desc, sending sig and
+// then SIGKILL if the process still exists after timeout. A negative pid stops the process group -pid, in
+// which case SIGKILL is sent if any member of the group remains.
+//
+// This gives the process a chance to exit gracefully even when this program is killed. The helper logs
+// whether the process exited or had to be killed.
+func (k *Killer) Terminate(desc string, pid int, sig syscall.Signal, timeout time.Duration) (cancel func() error, _ error) {
+	return k.terminate(desc, pid, []syscall.Signal{sig, syscall.SIGKILL}, timeout)
+}
+
+// terminate queues sending each of sigs to pid in turn until it has exited, waiting up to timeout after each.
+func (k *Killer) terminate(desc string, pid int, sigs []syscall.Signal, timeout time.Duration) (func() error, error) {
+	desc = strings.ReplaceAll(desc, "\n", " ")
+	start, _ := processStart(pid)
+	list := make([]string, len(sigs))
+	for i, sig := range sigs {
+		list[i] = strconv.Itoa(int(sig))
+	}
+	// signals timeout pid start desc
+	data := fmt.Sprintf("%s %d %d %d %s", strings.Join(list, ","), timeout.Milliseconds(), pid, start, desc)
+	return k.queue(opTerm, PriorityKill, data)
 }
 
-// Close closes k.
+// Close closes k and every Killer sharing its helper, which runs the commands queued and not cancelled.
 //
 // In most circumstances it is not necessary to manually call close and can be depended on
 // to close automatically when the program exits.
 func (k *Killer) Close() error {
-	return k.w.Close()
+	return k.conn.close()
+}
+
+// Share makes the [DefaultKiller] of the program run by cmd queue its commands in the helper of k instead of
+// starting its own, if the program uses this package. The pipe commands are written to is added to the
+// ExtraFiles of cmd and its fd set in the ONEXIT_HELPER_FD environment variable, added to the environment of
+// this program if cmd.Env is nil. Share must be called before cmd is started and the caller owns the returned
+// copy of the pipe, closing it once cmd has started.
+//
+// The helper runs the commands of a program sharing it once that program exits, or once this program exits
+// if it does so first, so killing this program also cleans up after the programs it started and the
+// programs they started in turn. Commands of other
+// programs aren't acknowledged to them, aren't journaled and are lost if the helper has to be respawned. A
+// program sharing the helper falls back to its own helper if the shared one exits, and [Killer.Flush]
+// doesn't wait for its commands to run.
+//
+// Commands longer than PIPE_BUF, 4096 bytes on Linux, may be interleaved with those of other programs.
+func (k *Killer) Share(cmd *exec.Cmd) (*os.File, error) {
+	w, err := k.conn.share()
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	// ExtraFiles start at fd 3
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", helperFDEnv, 2+len(cmd.ExtraFiles)))
+	return w, nil
+}
+
+// Healthy reports whether the helper is running and acknowledging commands.
+func (k *Killer) Healthy() bool {
+	return k.Err() == nil
+}
+
+// Err returns the reason the helper is not healthy or nil if it is.
+//
+// A helper that exits is respawned with every command queued and not cancelled, so a Killer usually only
+// stays unhealthy if the helper can't be started.
+func (k *Killer) Err() error {
+	return k.conn.health()
 }
 
 // OnExitF queues the shell command specified by format and args to be run when this process exits.
@@ -92,59 +262,45 @@ func (k *Killer) OnExitF(format string, args ...any) (cancel func() error, _ err
 
 // OnExit queues the shell command command to be run when this process exits.
 func (k *Killer) OnExit(command string) (cancel func() error, _ error) {
-	return k.queue(command)
+	return k.queue(opExit, 0, command)
 }
 
-func (k *Killer) queue(command string) (func() error, error) {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-	seq := k.seq.Add(1)
-
-	if err := k.send(opExit, command); err != nil {
-		return nil, fmt.Errorf("onexit: failed to queue: %w", err)
+// queue queues op with data using priority unless another was set with [Priority].
+func (k *Killer) queue(op operation, priority int, data string) (func() error, error) {
+	if k.opts.priority != nil {
+		priority = *k.opts.priority
 	}
-	return func() error { return k.dequeue(seq) }, nil
-}
-
-func (k *Killer) dequeue(seq int64) error {
-	return k.send(opCancel, seq)
-}
-
-func (k *Killer) send(op operation, data any) error {
-	_, err := fmt.Fprintf(k.w, "%s:%v\n", op, data)
+	parallel := 0
+	if k.opts.parallel {
+		parallel = 1
+	}
+	// priority timeout parallel data
+	id, err := k.conn.queue(op, fmt.Sprintf("%d %d %d %s", priority, k.opts.timeout.Milliseconds(), parallel, data))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	k.scope.add(id)
+	return func() error {
+		k.scope.remove(id)
+		return k.conn.dequeue(id)
+	}, nil
 }
 
+// NewKiller returns a Killer using a [HelperShell] helper writing its logs to logWriter and logFile.
 func NewKiller(logWriter io.Writer, logFile string) (*Killer, error) {
-	script := onexit
-	if logFile != "" {
-		script = strings.TrimSuffix(script, "\n")
-		script += "2>&1 | tee " + logFile + "\n"
-	}
-
-	p := exec.Command("/bin/bash", "-c", script)
+	return New(Options{Helper: HelperShell, Log: logWriter, LogFile: logFile})
+}
 
-	r, w, err := os.Pipe()
+// New starts a helper process as configured by opts and returns a Killer queueing commands in it.
+func New(opts Options) (*Killer, error) {
+	c, err := newConn(opts)
 	if err != nil {
-		return nil, fmt.Errorf("onexit: failed to open pipe: %w", err)
+		return nil, err
 	}
-
-	p.Stdin = r
-	p.Stdout = logWriter
-	p.Stderr = logWriter
-	p.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	k := &Killer{w: w}
-	k.seq.Store(-1)
-	k.mu.Lock()
-	go func() {
-		_ = p.Start()
-		k.mu.Unlock()
-	}()
-	return k, nil
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return &Killer{conn: c, scope: newScope(nil)}, nil
 }
 
 // Kill runs [DefaultKiller.Kill].
@@ -152,6 +308,21 @@ func Kill(desc string, pid int, sig ...syscall.Signal) (cancel func() error, _ e
 	return DefaultKiller.Kill(desc, pid, sig...)
 }
 
+// With runs [DefaultKiller.With].
+func With(opts ...Option) *Killer {
+	return DefaultKiller.With(opts...)
+}
+
+// Scope runs [DefaultKiller.Scope].
+func Scope() *Killer {
+	return DefaultKiller.Scope()
+}
+
+// Terminate runs [DefaultKiller.Terminate].
+func Terminate(desc string, pid int, sig syscall.Signal, timeout time.Duration) (cancel func() error, _ error) {
+	return DefaultKiller.Terminate(desc, pid, sig, timeout)
+}
+
 // OnExitF runs [DefaultKiller.OnExitF].
 func OnExitF(format string, args ...any) (cancel func() error, _ error) {
 	return DefaultKiller.OnExit(fmt.Sprintf(format, args...))
@@ -1,37 +1,346 @@
 #!/bin/bash
 
 (
+	# logs may be written to a pipe read by the program which is gone once it has exited
+	trap '' PIPE
+
+	# the commands run must not inherit the configuration of the helper, a program using the package would
+	# run as a helper or share this one
+	events="$ONEXIT_HELPER_EVENTS"
+	journal="$ONEXIT_HELPER_JOURNAL"
+	read -r owner owner_start <<<"$ONEXIT_HELPER_OWNER"
+	unset ONEXIT_HELPER ONEXIT_HELPER_LOG ONEXIT_HELPER_JOURNAL ONEXIT_HELPER_EVENTS ONEXIT_HELPER_OWNER ONEXIT_HELPER_FD
+
 	opExit=exit
+	opKill=kill
+	opTerm=term
+	opRm=rm
+	opUmount=umount
+	opArgv=argv
+	opWrite=write
 	opCancel=cancel
+	opRun=run
+
+	# commands and their options by id and ids in the order they were queued
+	declare -A cmds prios timeouts parallels ops descs
+	ids=()
+
+	# ack acknowledges id on fd 3 which is gone if the program has exited
+	ack() {
+		{ echo "ack:$1" >&3; } 2>/dev/null
+	}
+
+	# reused pid start succeeds if pid, or the leader of the process group -pid, now identifies a different
+	# process than the one that started at start in clock ticks after boot. A start of 0 is unknown.
+	reused() {
+		local pid="${1#-}" start="$2" stat fields
+		((start != 0)) || return 1
+		stat="$(cat "/proc/$pid/stat" 2>/dev/null)" || return 1
+		# comm may contain spaces and parentheses, starttime is field 22
+		read -ra fields <<<"${stat##*)}"
+		((fields[19] != start))
+	}
+
+	# signal desc signal pid start sends signal to pid unless it was reused
+	signal() {
+		local desc="$1" sig="$2" pid="$3" start="$4"
+		if reused "$pid" "$start"; then
+			echo "onexit: $desc already exited, pid $pid was reused"
+			return
+		fi
+		echo "killing $desc"
+		kill -"$sig" -- "$pid"
+	}
+
+	# terminate desc signals timeout-ms pid start sends each of the comma separated signals to pid in turn
+	# until it no longer exists, waiting up to the timeout after each, see Killer.Terminate.
+	terminate() {
+		local desc="$1" sigs="$2" timeout="$3" pid="$4" start="$5" sig i=0 sent
+		if reused "$pid" "$start"; then
+			echo "onexit: $desc already exited, pid $pid was reused"
+			return
+		fi
+		echo "terminating $desc"
+		local begin=${EPOCHREALTIME/./}
+		IFS=, read -ra sigs <<<"$sigs"
+		for sig in "${sigs[@]}"; do
+			if ((i++ > 0)); then
+				echo "onexit: $desc still running after ${timeout}ms, sending signal $sig"
+			fi
+			kill -"$sig" -- "$pid" || return
+			((i < ${#sigs[@]})) || return 0
+			sent=${EPOCHREALTIME/./}
+			# signal 0 only checks whether the process or any member of the group exists
+			while kill -0 -- "$pid" 2>/dev/null && (((${EPOCHREALTIME/./} - sent) / 1000 < timeout)); do
+				sleep 0.05
+			done
+			if ! kill -0 -- "$pid" 2>/dev/null; then
+				echo "onexit: $desc exited after $(((${EPOCHREALTIME/./} - begin) / 1000))ms"
+				return
+			fi
+		done
+	}
+
+	# remove path removes path unless it is empty or /, see Killer.RemoveAll
+	remove() {
+		if [[ -z "$1" || "$1" == / ]]; then
+			echo "refusing to remove '$1'"
+			return 1
+		fi
+		rm -rf -- "$1"
+	}
+
+	# write path data writes data to the existing file path, see Killer.WriteFile
+	write() {
+		printf %s "$2" >"$1"
+	}
+
+	# commands with a timeout run in their own bash
+	export -f reused signal terminate remove write
+
+	# json string prints string escaped to be quoted in JSON
+	json() {
+		local s="$1"
+		s="${s//\\/\\\\}"
+		s="${s//\"/\\\"}"
+		s="${s//$'\t'/\\t}"
+		s="${s//$'\r'/\\r}"
+		s="${s//$'\n'/\\n}"
+		printf %s "$s"
+	}
+
+	# millis prints the time in milliseconds
+	millis() {
+		echo $((${EPOCHREALTIME/./} / 1000))
+	}
+
+	# event type id [status duration-ms error] appends an event for the command id to the event log, see
+	# Event
+	event() {
+		[[ -n "$events" ]] || return 0
+		local t="$EPOCHREALTIME" zone time
+		printf -v zone '%(%z)T' "${t%.*}"
+		printf -v time '%(%Y-%m-%dT%H:%M:%S)T.%s%s:%s' "${t%.*}" "${t#*.}" "${zone:0:3}" "${zone:3}"
+		printf '{"time":"%s","type":"%s","id":"%s","op":"%s","desc":"%s","status":%d,"duration_ms":%d,"error":"%s"}\n' \
+			"$time" "$1" "$(json "$2")" "${ops[$2]}" "$(json "${descs[$2]}")" "${3:-0}" "${4:-0}" "$(json "$5")" \
+			>>"$events"
+	}
 
-	cmds=()
+	# run id runs the command id logging and recording whether it failed or timed out
+	run() {
+		local cmd="${cmds[$1]}" timeout="${timeouts[$1]}" start status
+		echo "onexit: > $cmd"
+		start=$(millis)
+		if ((timeout > 0)); then
+			timeout -k 1 "$(printf %d.%03d $((timeout / 1000)) $((timeout % 1000)))" bash -c "$cmd"
+			status=$?
+			if ((status == 124 || status == 137)); then
+				echo "onexit: command timed out after ${timeout}ms: $cmd"
+				event failed "$1" 124 $(($(millis) - start)) "timed out after ${timeout}ms"
+				return
+			fi
+		else
+			# a subshell so commands such as exit can't end the helper
+			(eval "$cmd")
+			status=$?
+		fi
+		if ((status != 0)); then
+			echo "onexit: command failed: $cmd"
+			event failed "$1" "$status" $(($(millis) - start)) "exit status $status"
+			return
+		fi
+		event executed "$1" 0 $(($(millis) - start))
+	}
+
+	# run_all ids... runs the commands ids, given in the order they were queued, highest priority first then
+	# last queued first. Commands marked parallel run alongside the rest of their priority.
+	run_all() {
+		local ids=("$@") prio pids i id
+		for prio in $(for id in "${ids[@]}"; do echo "${prios[$id]}"; done | sort -nru); do
+			pids=()
+			for ((i = ${#ids[@]} - 1; i >= 0; i--)); do
+				id="${ids[i]}"
+				if ((prios[$id] == prio && parallels[$id] == 1)); then
+					run "$id" &
+					pids+=($!)
+				fi
+			done
+			for ((i = ${#ids[@]} - 1; i >= 0; i--)); do
+				id="${ids[i]}"
+				if ((prios[$id] == prio && parallels[$id] != 1)); then
+					run "$id"
+				fi
+			done
+			((${#pids[@]} == 0)) || wait "${pids[@]}"
+		done
+	}
+
+	# queued lists the ids of commands that are queued and not cancelled in the order they were queued
+	queued() {
+		local id
+		for id in "$@"; do
+			if [[ -v cmds[$id] ]]; then
+				echo "$id"
+			fi
+		done
+	}
+
+	# alive pid start succeeds unless pid has exited, including if it is a zombie waiting to be reaped, or
+	# was reused. A start of 0 is unknown.
+	alive() {
+		local stat fields
+		stat="$(cat "/proc/$1/stat" 2>/dev/null)" || return 1
+		read -ra fields <<<"${stat##*)}"
+		[[ "${fields[0]}" != Z ]] && ((${2:-0} == 0 || fields[19] == ${2:-0}))
+	}
+
+	# owner_alive succeeds unless the owner, the program that started the helper, has exited. The commands
+	# run once it exits even if programs sharing the helper keep stdin open.
+	owner_alive() {
+		[[ -z "$owner" ]] || alive "$owner" "$owner_start"
+	}
+
+	# programs sharing the helper by the prefix of their ids, "pid-start"
+	declare -A sharers
+
+	# run_exited_sharers runs the commands of the programs sharing the helper that have exited
+	run_exited_sharers() {
+		local prefix id run
+		for prefix in "${!sharers[@]}"; do
+			! alive "${prefix%-*}" "${prefix#*-}" || continue
+			unset "sharers[$prefix]"
+			run=()
+			for id in "${ids[@]}"; do
+				if [[ "$id" == "$prefix".* && -v cmds[$id] ]]; then
+					run+=("$id")
+				fi
+			done
+			echo "onexit: $prefix exited - running ${#run[@]} commands"
+			run_all "${run[@]}" &
+			for id in "${run[@]}"; do
+				unset "cmds[$id]"
+			done
+		done
+	}
+
+	# next reads the next line into line, failing once stdin is closed or the owner has exited. Programs
+	# sharing the helper are checked at most every 200ms.
+	partial=
+	checked=0
+	next() {
+		local status
+		while true; do
+			if ((${EPOCHREALTIME/./} - checked >= 200000)); then
+				run_exited_sharers
+				checked=${EPOCHREALTIME/./}
+			fi
+			read -r -t 0.2 line
+			status=$?
+			if ((status == 0)); then
+				line="$partial$line"
+				partial=
+				return 0
+			fi
+			if ((status <= 128)); then
+				echo "onexit: stdin closed - running commands"
+				return 1
+			fi
+			# a read timing out keeps what it read of the line
+			partial+="$line"
+			if ! owner_alive; then
+				echo "onexit: owner exited - running commands"
+				return 1
+			fi
+		done
+	}
 
 	echo "onexit: running"
 
-	while read -r cmd; do
-		case "$cmd" in
-		${opExit}:*)
-			command="${cmd#${opExit}:}"
-			echo "onexit: queued: $command"
-			cmds+=("$command")
+	while next; do
+		op="${line%%:*}"
+		payload="${line#*:}"
+		case "$op" in
+		"$opExit")
+			# id priority timeout parallel command
+			read -r id prio timeout parallel command <<<"$payload"
+			echo "onexit: queued $id: $command"
+			cmds[$id]="$command"
+			descs[$id]="$command"
+			;;
+		"$opKill")
+			# id priority timeout parallel signal pid start desc
+			read -r id prio timeout parallel sig pid start desc <<<"$payload"
+			echo "onexit: queued $id: $sig $pid $start $desc"
+			cmds[$id]="signal $(printf %q "${desc:-$pid}") $sig $pid $start"
+			descs[$id]="${desc:-$pid}"
+			;;
+		"$opTerm")
+			# id priority timeout parallel signals timeout pid start desc
+			read -r id prio timeout parallel sigs grace pid start desc <<<"$payload"
+			echo "onexit: queued $id: $sigs $grace $pid $start $desc"
+			cmds[$id]="terminate $(printf %q "${desc:-$pid}") $sigs $grace $pid $start"
+			descs[$id]="${desc:-$pid}"
+			;;
+		"$opRm" | "$opUmount" | "$opArgv" | "$opWrite")
+			# id priority timeout parallel words... where words are quoted by the program
+			read -r id prio timeout parallel words <<<"$payload"
+			echo "onexit: queued $id: $words"
+			case "$op" in
+			"$opRm") cmds[$id]="remove $words" ;;
+			"$opUmount") cmds[$id]="umount -- $words" ;;
+			"$opArgv") cmds[$id]="$words" ;;
+			"$opWrite") cmds[$id]="write $words" ;;
+			esac
+			descs[$id]="$words"
 			;;
-		${opCancel}:*)
-			i=${cmd#${opCancel}:}
-			echo "onexit: cancelling $i: ${cmds[$i]}"
-			cmds[$i]=""
+		"$opCancel")
+			id="$payload"
+			if [[ -v cmds[$id] ]]; then
+				echo "onexit: cancelling $id: ${cmds[$id]}"
+				event cancelled "$id"
+				unset "cmds[$id]"
+			fi
+			ack "$id"
+			continue
+			;;
+		"$opRun")
+			# id ids where ids are comma separated, acknowledged once the commands have run
+			read -r id list <<<"$payload"
+			IFS=, read -ra flush <<<"$list"
+			mapfile -t flush < <(queued "${flush[@]}")
+			echo "onexit: running ${#flush[@]} commands of $id"
+			(
+				run_all "${flush[@]}"
+				ack "$id"
+			) &
+			for i in "${flush[@]}"; do
+				unset "cmds[$i]"
+			done
+			continue
 			;;
 		*)
-			echo "onexit: invalid command: $cmd"
+			echo "onexit: invalid command: $line"
+			continue
 			;;
 		esac
+		if [[ "$id" == *.* ]]; then
+			sharers[${id%%.*}]=1
+		fi
+		prios[$id]="$prio"
+		timeouts[$id]="$timeout"
+		parallels[$id]="$parallel"
+		ops[$id]="$op"
+		ids+=("$id")
+		event queued "$id"
+		ack "$id"
 	done
 
-	echo "onexit: stdin closed - running commands"
+	mapfile -t ids < <(queued "${ids[@]}")
+	run_all "${ids[@]}"
+	# commands run early by a scope
+	wait
 
-	for cmd in "${cmds[@]}"; do
-		if [ -n "$cmd" ]; then
-			echo "onexit: > $cmd"
-			eval "$cmd" || echo "onexit: command failed: $cmd"
-		fi
-	done
+	if [[ -n "$journal" ]]; then
+		rm -f "$journal"
+	fi
 )
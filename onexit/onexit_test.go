@@ -5,56 +5,305 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/matryer/is"
 )
 
+var helpers = map[string]Helper{"exec": HelperExec, "shell": HelperShell}
+
 func TestOnExit(t *testing.T) {
 	t.Parallel()
 
-	t.Run("with cancel", func(t *testing.T) {
-		t.Parallel()
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
 
-		is := is.New(t)
+			t.Run("with cancel", func(t *testing.T) {
+				t.Parallel()
 
-		k, err := NewKiller(io.Discard, "")
-		is.NoErr(err)
-		fn := filepath.Join(t.TempDir(), "johncena.log")
+				is := is.New(t)
 
-		cancel, err := k.OnExit(fmt.Sprintf("echo -n 'Hello, World!' > %s", fn))
-		is.NoErr(err)
-		// cancel the exit command
-		cancel()
-		is.NoErr(k.Close())
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				fn := filepath.Join(t.TempDir(), "johncena.log")
 
-		// short sleep to let the exit script run in the background
-		time.Sleep(10 * time.Millisecond)
-		_, err = os.Stat(fn)
-		is.True(errors.Is(err, os.ErrNotExist))
-	})
+				cancel, err := k.OnExit(fmt.Sprintf("echo -n 'Hello, World!' > %s", fn))
+				is.NoErr(err)
+				// cancel the exit command
+				cancel()
+				is.NoErr(k.Close())
+
+				// short sleep to let the exit script run in the background
+				time.Sleep(10 * time.Millisecond)
+				_, err = os.Stat(fn)
+				is.True(errors.Is(err, os.ErrNotExist))
+			})
+
+			t.Run("no cancel", func(t *testing.T) {
+
+				is := is.New(t)
+
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				f, err := os.CreateTemp(t.TempDir(), "test.log")
+				fn := f.Name()
+				is.NoErr(f.Close())
+
+				_, err = k.OnExit(fmt.Sprintf("echo -n 'Hello, World!' > %s", fn))
+				is.NoErr(err)
+				is.NoErr(k.Close())
+
+				waitFor(t, func() bool {
+					contents, _ := os.ReadFile(fn)
+					return string(contents) == "Hello, World!"
+				})
+			})
+
+			t.Run("idle", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				fn := filepath.Join(t.TempDir(), "ran")
+				_, err = k.OnExitF("touch %s", fn)
+				is.NoErr(err)
+
+				// the helper polls its owner between reads so waiting for the next command must not run them
+				time.Sleep(500 * time.Millisecond)
+				_, err = os.Stat(fn)
+				is.True(errors.Is(err, os.ErrNotExist))
+
+				is.NoErr(k.Close())
+				waitFor(t, func() bool {
+					_, err := os.Stat(fn)
+					return err == nil
+				})
+			})
+
+			t.Run("respawn", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				is.True(k.Healthy())
+				dir := t.TempDir()
+				_, err = k.OnExitF("touch %s/queued", dir)
+				is.NoErr(err)
+				cancel, err := k.OnExitF("touch %s/cancelled", dir)
+				is.NoErr(err)
+				is.NoErr(cancel())
+
+				k.conn.mu.Lock()
+				helper := k.conn.helper
+				k.conn.mu.Unlock()
+				is.NoErr(helper.process.Kill())
+				waitFor(t, func() bool {
+					k.conn.mu.Lock()
+					defer k.conn.mu.Unlock()
+					return k.conn.helper != helper && k.conn.err == nil
+				})
+				is.True(k.Healthy())
+
+				_, err = k.OnExitF("touch %s/after", dir)
+				is.NoErr(err)
+				is.NoErr(k.Close())
+				waitFor(t, func() bool {
+					_, errQueued := os.Stat(filepath.Join(dir, "queued"))
+					_, errAfter := os.Stat(filepath.Join(dir, "after"))
+					return errQueued == nil && errAfter == nil
+				})
+				_, err = os.Stat(filepath.Join(dir, "cancelled"))
+				is.True(errors.Is(err, os.ErrNotExist))
+			})
+
+			t.Run("order", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				fn := filepath.Join(t.TempDir(), "order")
+				for _, c := range []struct {
+					name     string
+					priority int
+				}{{"first", 0}, {"second", 0}, {"high", 5}, {"low", -5}} {
+					_, err := k.With(Priority(c.priority)).OnExitF("echo %s >> %s", c.name, fn)
+					is.NoErr(err)
+				}
+				is.NoErr(k.Close())
+				waitFor(t, func() bool {
+					b, _ := os.ReadFile(fn)
+					return string(b) == "high\nsecond\nfirst\nlow\n"
+				})
+			})
 
-	t.Run("no cancel", func(t *testing.T) {
+			t.Run("timeout and parallel", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				dir := t.TempDir()
+				_, err = k.With(Timeout(100 * time.Millisecond)).OnExit("sleep 60")
+				is.NoErr(err)
+				// each waits for the other so only finish if run in parallel
+				parallel := k.With(Priority(1), Parallel(), Timeout(10*time.Second))
+				_, err = parallel.OnExitF("touch %[1]s/a; until [ -e %[1]s/b ]; do sleep 0.01; done", dir)
+				is.NoErr(err)
+				_, err = parallel.OnExitF("touch %[1]s/b; until [ -e %[1]s/a ]; do sleep 0.01; done", dir)
+				is.NoErr(err)
+				_, err = k.With(Priority(-1)).OnExitF("touch %s/done", dir)
+				is.NoErr(err)
+
+				start := time.Now()
+				is.NoErr(k.Close())
+				waitFor(t, func() bool {
+					_, err := os.Stat(filepath.Join(dir, "done"))
+					return err == nil
+				})
+				is.True(time.Since(start) < 3*time.Second)
+			})
+
+			t.Run("terminate", func(t *testing.T) {
+				t.Parallel()
+
+				for _, tc := range []struct {
+					name   string
+					script string
+					signal syscall.Signal
+					log    string
+				}{
+					{"graceful", `trap 'exit 0' TERM; echo ready; while true; do sleep 0.01; done`, 0, "exited after"},
+					{"escalate", `trap '' TERM; echo ready; while true; do sleep 0.01; done`, syscall.SIGKILL, "still running after 200ms, sending signal 9"},
+				} {
+					t.Run(tc.name, func(t *testing.T) {
+						t.Parallel()
+
+						is := is.New(t)
+						p := exec.Command("bash", "-c", tc.script)
+						p.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+						stdout, err := p.StdoutPipe()
+						is.NoErr(err)
+						is.NoErr(p.Start())
+						_, err = stdout.Read(make([]byte, len("ready\n")))
+						is.NoErr(err)
+						exited := make(chan error, 1)
+						go func() { exited <- p.Wait() }()
+
+						logFile := filepath.Join(t.TempDir(), "onexit.log")
+						k, err := New(Options{Helper: helper, LogFile: logFile})
+						is.NoErr(err)
+						_, err = k.Terminate("bash", -p.Process.Pid, syscall.SIGTERM, 200*time.Millisecond)
+						is.NoErr(err)
+						is.NoErr(k.Close())
+
+						select {
+						case err := <-exited:
+							if tc.signal == 0 {
+								is.NoErr(err)
+							} else {
+								is.Equal(p.ProcessState.Sys().(syscall.WaitStatus).Signal(), tc.signal)
+							}
+						case <-time.After(5 * time.Second):
+							t.Fatal("process was not terminated")
+						}
+						waitFor(t, func() bool {
+							logs, _ := os.ReadFile(logFile)
+							return strings.Contains(string(logs), "onexit: bash "+tc.log)
+						})
+					})
+				}
+			})
+
+			t.Run("kill", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+
+				sleep := exec.Command("sleep", "60")
+				is.NoErr(sleep.Start())
+				exited := make(chan error, 1)
+				go func() { exited <- sleep.Wait() }()
+
+				k, err := New(Options{Helper: helper, LogFile: filepath.Join(t.TempDir(), "onexit.log")})
+				is.NoErr(err)
+				_, err = k.Kill("sleep 'with' quotes", sleep.Process.Pid, syscall.SIGTERM)
+				is.NoErr(err)
+				is.NoErr(k.Close())
+
+				select {
+				case err := <-exited:
+					var exitErr *exec.ExitError
+					is.True(errors.As(err, &exitErr))
+					is.Equal(exitErr.Sys().(syscall.WaitStatus).Signal(), syscall.SIGTERM)
+				case <-time.After(5 * time.Second):
+					t.Fatal("process was not killed")
+				}
+			})
+		})
+	}
+
+	t.Run("start failure", func(t *testing.T) {
+		t.Parallel()
 
 		is := is.New(t)
+		for _, helper := range helpers {
+			_, err := New(Options{Helper: helper, Path: filepath.Join(t.TempDir(), "missing")})
+			is.True(err != nil)
+		}
+	})
 
-		k, err := NewKiller(io.Discard, "")
-		is.NoErr(err)
-		f, err := os.CreateTemp(t.TempDir(), "test.log")
-		fn := f.Name()
-		is.NoErr(f.Close())
+	t.Run("unhealthy", func(t *testing.T) {
+		t.Parallel()
 
-		_, err = k.OnExit(fmt.Sprintf("echo -n 'Hello, World!' > %s", fn))
-		is.NoErr(err)
-		is.NoErr(k.Close())
+		is := is.New(t)
+		for _, helper := range helpers {
+			// exits straight away without acknowledging anything
+			k, err := New(Options{Helper: helper, Path: "/bin/true"})
+			is.NoErr(err)
+			_, err = k.OnExit("true")
+			is.True(err != nil)
+			is.True(!k.Healthy())
+			is.True(k.Err() != nil)
+			_ = k.Close()
+		}
+	})
 
-		// short sleep to let the exit script run in the background
-		time.Sleep(10 * time.Millisecond)
-		contents, err := os.ReadFile(fn)
-		is.NoErr(err)
+	t.Run("log file", func(t *testing.T) {
+		t.Parallel()
 
-		is.Equal(contents, []byte("Hello, World!"))
+		for name, helper := range helpers {
+			is := is.New(t)
+			fn := filepath.Join(t.TempDir(), name+".log")
+			k, err := New(Options{Helper: helper, Log: io.Discard, LogFile: fn})
+			is.NoErr(err)
+			_, err = k.OnExit("true")
+			is.NoErr(err)
+			is.NoErr(k.Close())
+			waitFor(t, func() bool {
+				logs, _ := os.ReadFile(fn)
+				return string(logs) == "onexit: running\nonexit: queued 0: true\nonexit: stdin closed - running commands\nonexit: > true\n"
+			})
+		}
 	})
 }
+
+// waitFor waits for cond to be true while the helper runs in the background.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("condition not met")
+}
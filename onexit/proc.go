@@ -0,0 +1,30 @@
+package onexit
+
+import "github.com/matgreaves/run/internal/procfs"
+
+// processStart returns the time the process pid started in clock ticks after boot, telling it apart from a
+// later process reusing pid. A negative pid is the process group -pid so its leader is read.
+func processStart(pid int) (uint64, error) {
+	s, err := procfs.Read(max(pid, -pid))
+	return s.Start, err
+}
+
+// reused reports whether pid now identifies a different process than the one that started at start.
+// A start of 0 is unknown and never reused.
+//
+// A process group can't be reused while any member remains, so a group whose leader has exited is still the
+// same group.
+func reused(pid int, start uint64) bool {
+	if start == 0 {
+		return false
+	}
+	curr, err := processStart(pid)
+	return err == nil && curr != start
+}
+
+// alive reports whether the process pid that started at start is still running and not a zombie waiting to
+// be reaped. A start of 0 is unknown.
+func alive(pid int, start uint64) bool {
+	s, err := procfs.Read(pid)
+	return err == nil && s.State != 'Z' && (start == 0 || s.Start == start)
+}
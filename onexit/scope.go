@@ -0,0 +1,104 @@
+package onexit
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// scope is the set of commands queued by a [Killer] and every Killer derived from it.
+type scope struct {
+	parent *scope
+
+	mu  sync.Mutex
+	ids map[int64]struct{}
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{parent: parent, ids: map[int64]struct{}{}}
+}
+
+// add adds id to s and every scope enclosing it.
+func (s *scope) add(id int64) {
+	for ; s != nil; s = s.parent {
+		s.mu.Lock()
+		s.ids[id] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// remove removes ids from s and every scope enclosing it.
+func (s *scope) remove(ids ...int64) {
+	for ; s != nil; s = s.parent {
+		s.mu.Lock()
+		for _, id := range ids {
+			delete(s.ids, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// take removes every command from s returning their ids in the order they were queued.
+func (s *scope) take() []int64 {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	ids := slices.Sorted(maps.Keys(s.ids))
+	s.mu.Unlock()
+	s.remove(ids...)
+	return ids
+}
+
+// Scope returns a Killer sharing the helper and options of k whose commands are grouped so they can be run
+// early with [Killer.Flush] or cancelled with [Killer.Cancel]. Commands queued in the scope also belong to
+// the scope of k.
+//
+// Scopes are useful for tests that need the cleanups registered by each test to run before the next
+// instead of when the program exits.
+func (k *Killer) Scope() *Killer {
+	scoped := *k
+	scoped.scope = newScope(k.scope)
+	return &scoped
+}
+
+// Flush runs the commands queued in the scope of k and not cancelled now, in the same order they would run
+// when the program exits, and waits for them to finish. Flushed commands no longer run when the program
+// exits. The scope can still be used to queue more commands.
+//
+// Flush doesn't wait for the commands to run if the helper is shared by another program, see [Killer.Share].
+func (k *Killer) Flush() error {
+	ids := k.scope.take()
+	if len(ids) == 0 {
+		return nil
+	}
+	return k.conn.run(ids)
+}
+
+// Cancel cancels every command queued in the scope of k.
+func (k *Killer) Cancel() error {
+	var errs []error
+	for _, id := range k.scope.take() {
+		errs = append(errs, k.conn.dequeue(id))
+	}
+	return errors.Join(errs...)
+}
+
+type killerKey struct{}
+
+// WithKiller returns a copy of ctx carrying k, see [FromContext].
+//
+// [github.com/matgreaves/run.Process] queues the commands stopping processes in the Killer of its context.
+func WithKiller(ctx context.Context, k *Killer) context.Context {
+	return context.WithValue(ctx, killerKey{}, k)
+}
+
+// FromContext returns the Killer carried by ctx or [DefaultKiller] if it has none.
+func FromContext(ctx context.Context) *Killer {
+	if k, ok := ctx.Value(killerKey{}).(*Killer); ok && k != nil {
+		return k
+	}
+	return DefaultKiller
+}
@@ -0,0 +1,127 @@
+package onexit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestScope(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("flush", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				dir := t.TempDir()
+				fn := filepath.Join(dir, "order")
+
+				_, err = k.OnExitF("echo outside >> %s", fn)
+				is.NoErr(err)
+				scope := k.Scope()
+				for _, c := range []struct {
+					name     string
+					priority int
+				}{{"first", 0}, {"second", 0}, {"high", 5}} {
+					_, err := scope.With(Priority(c.priority)).OnExitF("echo %s >> %s", c.name, fn)
+					is.NoErr(err)
+				}
+				cancel, err := scope.OnExitF("echo cancelled >> %s", fn)
+				is.NoErr(err)
+				is.NoErr(cancel())
+
+				// the commands have run by the time Flush returns
+				is.NoErr(scope.Flush())
+				b, err := os.ReadFile(fn)
+				is.NoErr(err)
+				is.Equal(string(b), "high\nsecond\nfirst\n")
+				is.NoErr(scope.Flush())
+
+				// the scope can be reused and flushed commands don't run again
+				_, err = scope.OnExitF("echo after >> %s", fn)
+				is.NoErr(err)
+				is.NoErr(k.Close())
+				waitFor(t, func() bool {
+					b, _ := os.ReadFile(fn)
+					return string(b) == "high\nsecond\nfirst\nafter\noutside\n"
+				})
+			})
+
+			t.Run("nested", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				fn := filepath.Join(t.TempDir(), "order")
+
+				outer := k.Scope()
+				inner := outer.Scope()
+				_, err = outer.OnExitF("echo outer >> %s", fn)
+				is.NoErr(err)
+				_, err = inner.OnExitF("echo inner >> %s", fn)
+				is.NoErr(err)
+
+				is.NoErr(inner.Flush())
+				b, err := os.ReadFile(fn)
+				is.NoErr(err)
+				is.Equal(string(b), "inner\n")
+				is.NoErr(outer.Flush())
+				b, err = os.ReadFile(fn)
+				is.NoErr(err)
+				is.Equal(string(b), "inner\nouter\n")
+				is.NoErr(k.Close())
+			})
+
+			t.Run("cancel", func(t *testing.T) {
+				t.Parallel()
+
+				is := is.New(t)
+				k, err := New(Options{Helper: helper})
+				is.NoErr(err)
+				dir := t.TempDir()
+
+				scope := k.Scope()
+				_, err = scope.OnExitF("touch %s/cancelled", dir)
+				is.NoErr(err)
+				_, err = scope.Scope().OnExitF("touch %s/nested", dir)
+				is.NoErr(err)
+				_, err = k.OnExitF("touch %s/kept", dir)
+				is.NoErr(err)
+				is.NoErr(scope.Cancel())
+
+				is.NoErr(k.Close())
+				waitFor(t, func() bool {
+					_, err := os.Stat(filepath.Join(dir, "kept"))
+					return err == nil
+				})
+				for _, fn := range []string{"cancelled", "nested"} {
+					_, err = os.Stat(filepath.Join(dir, fn))
+					is.True(errors.Is(err, os.ErrNotExist))
+				}
+			})
+		})
+	}
+
+	t.Run("context", func(t *testing.T) {
+		t.Parallel()
+
+		is := is.New(t)
+		is.Equal(FromContext(context.Background()), DefaultKiller)
+		k, err := New(Options{})
+		is.NoErr(err)
+		defer k.Close()
+		scope := k.Scope()
+		is.Equal(FromContext(WithKiller(context.Background(), scope)), scope)
+	})
+}
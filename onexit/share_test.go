@@ -0,0 +1,101 @@
+package onexit
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// directory TestShareChild queues its commands to create files in when run by TestShare
+const shareDirEnv = "ONEXIT_TEST_SHARE_DIR"
+
+func TestShare(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			k, err := New(Options{Helper: helper})
+			is.NoErr(err)
+			dir := t.TempDir()
+
+			// the test binary is the child program using this package
+			cmd := exec.Command(os.Args[0], "-test.run=^TestShareChild$")
+			cmd.Env = append(os.Environ(), shareDirEnv+"="+dir)
+			w, err := k.Share(cmd)
+			is.NoErr(err)
+			out, err := cmd.CombinedOutput()
+			is.NoErr(w.Close())
+			if err != nil {
+				t.Fatalf("child failed: %v\n%s", err, out)
+			}
+
+			// the commands of the child run once it has exited while this program keeps running
+			waitFor(t, func() bool {
+				_, err := os.Stat(filepath.Join(dir, "queued"))
+				return err == nil
+			})
+			_, err = os.Stat(filepath.Join(dir, "cancelled"))
+			is.True(errors.Is(err, os.ErrNotExist))
+			is.NoErr(k.Close())
+		})
+	}
+}
+
+// TestShareChild is run by TestShare as a program sharing its helper.
+func TestShareChild(t *testing.T) {
+	dir := os.Getenv(shareDirEnv)
+	if dir == "" {
+		t.Skip("run by TestShare")
+	}
+	is := is.New(t)
+	is.True(DefaultKiller.conn.helper.shared)
+	is.Equal(os.Getenv(helperFDEnv), "")
+
+	_, err := OnExitF("touch %s/queued", dir)
+	is.NoErr(err)
+	cancel, err := OnExitF("touch %s/cancelled", dir)
+	is.NoErr(err)
+	is.NoErr(cancel())
+	is.True(DefaultKiller.Healthy())
+}
+
+func TestOwnerExit(t *testing.T) {
+	t.Parallel()
+
+	for name, helper := range helpers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			is := is.New(t)
+			owner := exec.Command("sleep", "60")
+			is.NoErr(owner.Start())
+			defer owner.Process.Kill()
+
+			c, err := newConn(Options{Helper: helper})
+			is.NoErr(err)
+			c.owner = owner.Process.Pid
+			is.NoErr(c.start())
+			k := &Killer{conn: c, scope: newScope(nil)}
+			defer k.Close()
+			dir := t.TempDir()
+			_, err = k.OnExitF("touch %s/queued", dir)
+			is.NoErr(err)
+
+			// the commands run once the owner exits even though the helper's input is still open, as when a
+			// program sharing the helper is still running
+			is.NoErr(owner.Process.Kill())
+			_ = owner.Wait()
+			waitFor(t, func() bool {
+				_, err := os.Stat(filepath.Join(dir, "queued"))
+				return err == nil
+			})
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Pipeline returns a [Runner] connecting the stdout of each process to the stdin of the next like a shell
+// pipeline `a | b | c`.
+//
+// Stdin of the first process and Stdout of the last are used as is, the Stdout and Stdin in between are
+// replaced by the pipes. Every process is run with [Process.Run] so each runs in its own process group,
+// is killed by the onexit package if this program exits abruptly, and is stopped when ctx is cancelled.
+//
+// Like a shell with pipefail set Pipeline returns a [*PipelineError] naming the last process to fail if any do.
+func Pipeline(procs ...Process) Runner {
+	return Func(func(ctx context.Context) error {
+		// pipes[i] connects procs[i] to procs[i+1]
+		type pipe struct{ r, w *os.File }
+		pipes := make([]pipe, max(len(procs)-1, 0))
+		for i := range pipes {
+			r, w, err := os.Pipe()
+			if err != nil {
+				for _, p := range pipes[:i] {
+					_, _ = p.r.Close(), p.w.Close()
+				}
+				return fmt.Errorf("run.Pipeline: failed to open pipe: %w", err)
+			}
+			pipes[i] = pipe{r: r, w: w}
+		}
+
+		errs := make([]error, len(procs))
+		var wg sync.WaitGroup
+		for i, p := range procs {
+			// this program's copies of the pipe ends need closing once the process has them so that
+			// readers see EOF and writers see EPIPE when the process at the other end exits
+			var ends []*os.File
+			if i > 0 {
+				p.Stdin = pipes[i-1].r
+				ends = append(ends, pipes[i-1].r)
+			}
+			if i < len(pipes) {
+				p.Stdout = pipes[i].w
+				ends = append(ends, pipes[i].w)
+			}
+			closeEnds := sync.OnceFunc(func() {
+				for _, f := range ends {
+					_ = f.Close()
+				}
+			})
+			p.started = func(int) { closeEnds() }
+			wg.Go(func() {
+				// closes if p never starts
+				defer closeEnds()
+				errs[i] = p.Run(ctx)
+			})
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return &PipelineError{Names: names(procs), Errs: errs}
+			}
+		}
+		return nil
+	})
+}
+
+func names(procs []Process) []string {
+	n := make([]string, len(procs))
+	for i, p := range procs {
+		n[i] = p.Name
+	}
+	return n
+}
+
+// PipelineError is returned by [Pipeline] when one or more processes fail.
+type PipelineError struct {
+	// names of the processes in the pipeline
+	Names []string
+	// the error returned by each process in the pipeline, nil if the process succeeded
+	Errs []error
+}
+
+// Stage returns the index of the last process in the pipeline to fail as reported by a shell with pipefail set.
+func (e *PipelineError) Stage() int {
+	for i := len(e.Errs) - 1; i >= 0; i-- {
+		if e.Errs[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *PipelineError) Error() string {
+	i := e.Stage()
+	if i < 0 {
+		return "run.Pipeline: no error"
+	}
+	return fmt.Sprintf("run.Pipeline[%d:%s] (%s): %v", i, e.Names[i], strings.Join(e.Names, " | "), e.Errs[i])
+}
+
+// Unwrap returns the errors of every process that failed.
+func (e *PipelineError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,60 @@
+package run_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestPipeline(t *testing.T) {
+	t.Parallel()
+
+	t.Run("connects stages", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		last := run.Command("sort")
+		buf := &bytes.Buffer{}
+		last.Stdout = buf
+		first := run.Command("cat")
+		first.Stdin = strings.NewReader("b\na\nc\n")
+		err := run.Pipeline(first, run.Command("tr", "a-z", "A-Z"), last).Run(t.Context())
+		is.NoErr(err)
+		is.Equal(buf.String(), "A\nB\nC\n")
+	})
+
+	t.Run("pipefail", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		err := run.Pipeline(
+			run.Command("echo", "hello"),
+			run.Command("grep", "goodbye"),
+			run.Command("cat"),
+		).Run(t.Context())
+		var perr *run.PipelineError
+		is.True(errors.As(err, &perr))
+		is.Equal(perr.Stage(), 1)
+		is.True(perr.Errs[0] == nil)
+		is.True(perr.Errs[2] == nil)
+		var procErr *run.ProcessError
+		is.True(errors.As(err, &procErr))
+		is.Equal(procErr.Name, "grep")
+		is.True(strings.HasPrefix(err.Error(), "run.Pipeline[1:grep] (echo | grep | cat): "))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := run.Pipeline(run.Command("sleep", "60"), run.Command("cat")).Run(ctx)
+		is.True(err != nil) // sleep is interrupted
+		is.True(time.Since(start) < run.ShutdownTimeout/2)
+	})
+}
@@ -1,12 +1,21 @@
 package run
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/matgreaves/run/onexit"
 )
@@ -24,25 +33,90 @@ type Process struct {
 	Args []string
 	// environment variables
 	Env map[string]string
+	// dotenv files environment variables are loaded from, see [Process.Environ].
+	EnvFiles []string
 
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+	// run the process attached to a pseudo-terminal, see [TTY].
+	TTY *TTY
 
 	// inherit environment variables from os.Env.
-	// Env takes priority over os variables.
+	// Env takes priority over os variables. The environment is also inherited if DoNotInherit or
+	// InheritOnly is set, or neither Env nor EnvFiles is, see [Process.Environ].
 	InheritOSEnv bool
-	// A list of environment variables to exclude when InheritOSEnv is true.
+	// A list of environment variables to exclude from those inherited.
+	// Entries may be patterns as in [path.Match] such as "AWS_*".
 	DoNotInherit []string
+	// When not empty only environment variables matching one of these patterns are inherited.
+	// DoNotInherit is applied after InheritOnly.
+	InheritOnly []string
+
+	// signal sent to stop the process when ctx is cancelled. Defaults to syscall.SIGINT.
+	StopSignal syscall.Signal
+	// time the process has to exit after StopSignal before being sent a SIGKILL.
+	// Defaults to half of [ShutdownTimeout].
+	StopTimeout time.Duration
+	// stop every descendant of the process found by walking /proc instead of only the process group.
+	// This catches descendants that moved into their own session or process group such as daemons.
+	//
+	// Descendants are found through their parent so one whose parent exited before the process is stopped,
+	// such as a double forked daemon, has been reparented to init or a subreaper and escapes unless it
+	// stayed in the process group. Use [Process.Cgroup] to stop every descendant.
+	KillTree bool
+	// signals received by this program that are forwarded to the process group of the process such as
+	// syscall.SIGHUP to reload configuration. See also [ForwardSignals].
+	//
+	// While the process runs these signals no longer take their default action in this program.
+	ForwardSignals []os.Signal
+	// let a process built on this package queue its onexit commands in the helper of the [onexit.Killer] of
+	// ctx instead of starting its own, see [onexit.Killer.Share]. Killing this program then also stops the
+	// processes started by the process.
+	ShareOnExit bool
+
+	// resource limits applied to the process with prlimit(2) before the program runs, the process is stopped
+	// at exec with ptrace(2) while they are applied. Where ptrace is denied, such as by Yama's ptrace_scope 3
+	// or a seccomp profile, or the program is setuid, setgid or has file capabilities, which exec drops
+	// under ptrace, they are applied just after the process starts instead so it may briefly run without them.
+	// Raising limits above this program's hard limits requires CAP_SYS_RESOURCE.
+	Limits map[Resource]Rlimit
+	// place the process and its descendants in a dedicated cgroup v2, see [Cgroup].
+	Cgroup *Cgroup
+	// sample the resource usage of the process while it runs, see [Sampler].
+	Sampler *Sampler
+	// log each line of output as a record of Logger with the process name added as a "process" attribute.
+	// JSON and logfmt lines keep their level, message and attributes, other lines are logged at info level.
+	// Output is still written to Stdout and Stderr if they are set.
+	Logger *slog.Logger
+	// keep the last TailLines lines of output in memory to attach to a [ProcessError], see also [Tail].
+	TailLines int
+	// called with a [Handle] to the process once it has started and been registered with the [onexit.Killer]
+	// of ctx. OnStart is called from Run so must not block.
+	OnStart func(*Handle)
+
+	// called with the pid of the process once it has started
+	started func(pid int)
 }
 
+const (
+	// poll interval used to wait for a process tree to exit
+	treePollInterval = 10 * time.Millisecond
+	// time to wait for a process tree to exit after being sent a SIGKILL
+	treeKillWait = time.Second
+)
+
 // Run implements [Runner] starting the external process.
 //
 // The process can be shut down by cancelling ctx. In this case the process and all child processes
+// will receive StopSignal, escalating to a SIGKILL if they haven't exited after StopTimeout.
 //
-//	will receive a SIGINT.
+// If this program exits without stopping the process, for example because it was killed, the process group
+// is stopped the same way by the [onexit.Killer] of ctx, see [onexit.WithKiller], which defaults to
+// [onexit.DefaultKiller].
 //
-// If this program or p do not terminate gracefully then a SIGKILL will be sent to the process group.
+// Output written to anything but an [*os.File], including by a Logger or kept for TailLines, is copied for
+// up to StopTimeout plus a second after the process exits, output of processes it leaves running is cut off.
 func (p Process) Run(ctx context.Context) error {
 	var err error
 	p.Path, err = exec.LookPath(p.Path)
@@ -50,38 +124,305 @@ func (p Process) Run(ctx context.Context) error {
 		return err
 	}
 
+	env, err := p.Environ()
+	if err != nil {
+		return err
+	}
+
 	cmd := exec.CommandContext(ctx, p.Path, p.Args...)
 	cmd.Dir = p.Dir
+	cmd.Env = env
 	cmd.Stdin = p.Stdin
 	cmd.Stdout = p.Stdout
 	cmd.Stderr = p.Stderr
+	var logs []*logWriter
+	if p.Logger != nil {
+		logs = []*logWriter{newLogWriter(ctx, p.Logger, p.Name), newLogWriter(ctx, p.Logger, p.Name)}
+		cmd.Stdout = logs[0].writer(p.Stdout)
+		cmd.Stderr = logs[1].writer(p.Stderr)
+	}
+	tail := p.newRing(ctx)
+	if tail != nil {
+		cmd.Stdout = tail.writer(cmd.Stdout)
+		cmd.Stderr = tail.writer(cmd.Stderr)
+	}
+	// Output that isn't written to a file is copied through a pipe which processes left running, such as
+	// daemons, keep open so Wait stops copying once the process has exited. Wait also kills the process this
+	// long after ctx is done, by when stop has already escalated to a SIGKILL.
+	cmd.WaitDelay = p.stopTimeout() + treeKillWait
 
 	// Give the external process its own group to more easily clean up it and all of its children.
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var pt *tty
+	if p.TTY != nil {
+		if pt, err = p.TTY.attach(cmd); err != nil {
+			return err
+		}
+		defer pt.close()
+	}
+	killer := onexit.FromContext(ctx)
+	var shared *os.File
+	if p.ShareOnExit {
+		if shared, err = killer.Share(cmd); err != nil {
+			return fmt.Errorf("run: failed to share killer: %w", err)
+		}
+		defer shared.Close()
+	}
+	cg, err := p.createCgroup(cmd.SysProcAttr)
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	var stopping sync.WaitGroup
 	cmd.Cancel = func() error {
-		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+		stopping.Go(func() { p.stop(cmd.Process.Pid, cg, exited) })
 		return nil
 	}
 
-	if err := cmd.Start(); err != nil {
+	// signals are caught before starting so none arriving during start take their default action
+	signals := p.notifySignals(ctx)
+	defer signal.Stop(signals)
+
+	err = start(cmd, p.Limits)
+	// taken before registering with killer which can wait for the helper
+	startTime := time.Now()
+	if shared != nil {
+		// only the process needs the pipe once it has started
+		_ = shared.Close()
+	}
+	if err != nil {
+		if cg != nil {
+			_ = cg.remove()
+		}
 		return err
 	}
+	if pt != nil {
+		pt.start()
+	}
+	// abort stops the process when Run can't go on, waiting for it to exit
+	abort := func() {
+		_ = cmd.Cancel()
+		_ = cmd.Wait()
+		close(exited)
+		stopping.Wait()
+	}
+	// the process is registered with killer before anyone is told it started so it can be relied on to stop it
+	if cg != nil {
+		defer func() {
+			p.Cgroup.record(cg.usage())
+			_ = cg.remove()
+		}()
+		// processes left in the cgroup are killed if this program exits before removing it
+		cancel, err := killer.WriteFile(filepath.Join(cg.path, "cgroup.kill"), "1")
+		if err != nil {
+			abort()
+			return fmt.Errorf("run: failed to register killer: %w", err)
+		}
+		defer cancel()
+	}
 
-	cancel, err := onexit.Kill(p.Name, -cmd.Process.Pid, syscall.SIGKILL)
+	// processes are stopped concurrently so their stop timeouts don't add up
+	cancel, err := killer.With(onexit.Parallel()).Terminate(p.Name, -cmd.Process.Pid, p.stopSignal(), p.stopTimeout())
 	if err != nil {
-		cmd.Cancel()
+		abort()
 		return fmt.Errorf("run: failed to register killer: %w", err)
 	}
 	defer cancel()
 
+	if p.started != nil {
+		p.started(cmd.Process.Pid)
+	}
+	if p.OnStart != nil {
+		pid := cmd.Process.Pid
+		p.OnStart(&Handle{Pid: pid, Pgid: pid, StartTime: startTime, process: cmd.Process, done: exited})
+	}
+
+	var sampling sync.WaitGroup
+	if p.Sampler != nil {
+		sampling.Go(func() { p.Sampler.run(cmd.Process.Pid, exited) })
+	}
+	go forwardSignals(cmd.Process.Pid, signals, exited)
+
 	err = cmd.Wait()
-	return err
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// the process exited successfully
+		err = nil
+	}
+	close(exited)
+	// Cancel is always called before Wait returns so stopping has been added to if ctx was cancelled.
+	stopping.Wait()
+	sampling.Wait()
+	for _, l := range logs {
+		l.flush()
+	}
+	if tail != nil {
+		tail.flush()
+	}
+	if err != nil {
+		return p.exitError(cmd.ProcessState, tail, err)
+	}
+	return nil
+}
+
+// ProcessError is returned by [Process.Run] when the process exits unsuccessfully.
+type ProcessError struct {
+	// name of the process
+	Name string
+	// signal that terminated the process, 0 if the process exited by itself.
+	Signal syscall.Signal
+	// the resource limit that caused the process to be terminated, only valid if LimitExceeded is true.
+	Limit         Resource
+	LimitExceeded bool
+	// peak resource usage of the process if it was sampled by a [Sampler].
+	Usage *Usage
+	// last lines of output of the process if they were kept, see [Process.TailLines].
+	Output []string
+	// error returned waiting for the process, typically an [*exec.ExitError].
+	Err error
+}
+
+func (e *ProcessError) Error() string {
+	msg := fmt.Sprintf("run.Process[%s]: %v", e.Name, e.Err)
+	if e.LimitExceeded {
+		msg += fmt.Sprintf(": %s exceeded", e.Limit)
+	}
+	return msg
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+func (p Process) exitError(state *os.ProcessState, tail *ring, err error) *ProcessError {
+	perr := &ProcessError{Name: p.Name, Err: err}
+	if tail != nil {
+		perr.Output = tail.lines()
+	}
+	if p.Sampler != nil {
+		peak := p.Sampler.Peak()
+		perr.Usage = &peak
+	}
+	if state == nil {
+		return perr
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		perr.Signal = ws.Signal()
+	}
+	switch perr.Signal {
+	case syscall.SIGXCPU:
+		perr.Limit, perr.LimitExceeded = RlimitCPU, true
+	case syscall.SIGXFSZ:
+		perr.Limit, perr.LimitExceeded = RlimitFSize, true
+	case syscall.SIGKILL:
+		// the kernel sends SIGKILL once the hard CPU limit is reached
+		l, ok := p.Limits[RlimitCPU]
+		if ok && l.Max < uint64(math.MaxInt64/time.Second) && state.UserTime()+state.SystemTime() >= time.Duration(l.Max)*time.Second {
+			perr.Limit, perr.LimitExceeded = RlimitCPU, true
+		}
+	}
+	return perr
+}
+
+// createCgroup creates a cgroup for the process to be started with attr if p.Cgroup is set.
+//
+// A nil cgroup and error are returned if the process should run without a cgroup.
+func (p Process) createCgroup(attr *syscall.SysProcAttr) (*cgroup, error) {
+	if p.Cgroup == nil {
+		return nil, nil
+	}
+	cg, err := p.Cgroup.create(p.Name)
+	if err == nil {
+		if err = cg.place(attr); err != nil {
+			_ = cg.remove()
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("run: cgroup: %w", err)
+		if p.Cgroup.Required {
+			return nil, err
+		}
+		p.Cgroup.record(CgroupUsage{}, err)
+		return nil, nil
+	}
+	return cg, nil
+}
+
+func (p Process) stopSignal() syscall.Signal {
+	return cmp.Or(p.StopSignal, syscall.SIGINT)
+}
+
+func (p Process) stopTimeout() time.Duration {
+	return cmp.Or(p.StopTimeout, ShutdownTimeout/2)
+}
+
+// stop signals the process pid to exit with p.StopSignal escalating to a SIGKILL after p.StopTimeout.
+// If the process runs in cg every process in cg is killed on escalation.
+//
+// exited is closed once pid itself has exited.
+func (p Process) stop(pid int, cg *cgroup, exited <-chan struct{}) {
+	sig := p.stopSignal()
+	timeout := time.After(p.stopTimeout())
+
+	if p.KillTree {
+		// Descendants outliving pid are reparented away from the tree so the processes found now are
+		// remembered and waited on until they exit too.
+		if tree, err := processTree(pid); err == nil {
+			stopTree(pid, tree, sig, cg, timeout)
+			return
+		}
+		// without /proc only the process group can be stopped
+	}
+
+	_ = syscall.Kill(-pid, sig)
+	// a process paused through its Handle can't handle sig until it is continued
+	_ = syscall.Kill(-pid, syscall.SIGCONT)
+	select {
+	case <-exited:
+	case <-timeout:
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		if cg != nil {
+			_ = cg.kill()
+		}
+	}
+}
+
+// stopTree signals tree, the process tree of pid, with sig escalating to a SIGKILL once timeout fires and
+// waits for it to exit.
+func stopTree(pid int, tree []proc, sig syscall.Signal, cg *cgroup, timeout <-chan time.Time) {
+	signalTree(tree, sig)
+	signalTree(tree, syscall.SIGCONT)
+
+	tick := time.NewTicker(treePollInterval)
+	defer tick.Stop()
+	killed := false
+	for slices.ContainsFunc(tree, proc.alive) {
+		select {
+		case <-tick.C:
+		case <-timeout:
+			if killed {
+				return
+			}
+			// pick up anything started since the first signal
+			latest, _ := processTree(pid)
+			tree = append(latest, tree...)
+			signalTree(tree, syscall.SIGKILL)
+			if cg != nil {
+				_ = cg.kill()
+			}
+			// SIGKILL is delivered asynchronously so give the tree a moment to exit
+			killed = true
+			timeout = time.After(treeKillWait)
+		}
+	}
 }
 
+// Command returns a [Process] running cmd with args that inherits the environment of this program.
 func Command(cmd string, args ...string) Process {
 	return Process{
-		Name: filepath.Base(cmd),
-		Path: cmd,
-		Args: args,
+		Name:         filepath.Base(cmd),
+		Path:         cmd,
+		Args:         args,
+		InheritOSEnv: true,
 	}
 }
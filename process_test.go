@@ -1,10 +1,23 @@
 package run_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/matgreaves/run"
+	"github.com/matgreaves/run/onexit"
 	"github.com/matryer/is"
 )
 
@@ -17,3 +30,233 @@ func TestCommand(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(buf.String(), "Hello, World!\n")
 }
+
+func TestProcessEnv(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	// a literal not configuring its environment inherits it
+	buf := &bytes.Buffer{}
+	p := run.Process{Path: "sh", Args: []string{"-c", `echo "$PATH"`}, Stdout: buf}
+	is.NoErr(p.Run(t.Context()))
+	is.Equal(buf.String(), os.Getenv("PATH")+"\n")
+}
+
+func TestProcessStop(t *testing.T) {
+	t.Parallel()
+
+	t.Run("escalate to SIGKILL", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		ctx, cancel := context.WithCancel(t.Context())
+		p := run.Command("bash", "-c", "trap '' INT; echo ready; sleep 60")
+		p.StopTimeout = 100 * time.Millisecond
+		_, res := startReady(t, ctx, p)
+
+		start := time.Now()
+		cancel()
+		is.True(<-res != nil) // killed
+		is.True(time.Since(start) < run.ShutdownTimeout/2)
+	})
+
+	t.Run("kill tree", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		ctx, cancel := context.WithCancel(t.Context())
+		// the daemon leaves the session and process group of its parent
+		p := run.Command("bash", "-c", "setsid sleep 60 >/dev/null 2>&1 & echo $!; wait")
+		p.StopTimeout = 100 * time.Millisecond
+		p.KillTree = true
+		line, res := startReady(t, ctx, p)
+		daemon, err := strconv.Atoi(line)
+		is.NoErr(err)
+		is.True(running(daemon))
+
+		cancel()
+		<-res
+		is.True(!running(daemon))
+	})
+
+	t.Run("scoped killer", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		scope := onexit.Scope()
+		ctx := onexit.WithKiller(t.Context(), scope)
+		p := run.Command("sleep", "60")
+		// the command stopping the process is queued before OnStart is called
+		started := make(chan struct{})
+		p.OnStart = func(*run.Handle) { close(started) }
+		res := make(chan error, 1)
+		run.Go(ctx, p, res)
+		<-started
+
+		// flushing the scope stops the process as if this program had exited
+		is.NoErr(scope.Flush())
+		select {
+		case err := <-res:
+			is.True(err != nil) // interrupted
+		case <-time.After(5 * time.Second):
+			t.Fatal("process still running after flushing its scope")
+		}
+	})
+
+	t.Run("killer closed", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		k, err := onexit.New(onexit.Options{})
+		is.NoErr(err)
+		is.NoErr(k.Close())
+		// the process is stopped and waited for when it can't be registered
+		p := run.Command("sleep", "60")
+		started := false
+		p.OnStart = func(*run.Handle) { started = true }
+		start := time.Now()
+		is.True(p.Run(onexit.WithKiller(t.Context(), k)) != nil)
+		is.True(!started)
+		is.True(time.Since(start) < run.ShutdownTimeout/2)
+	})
+}
+
+func TestProcessLimits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("applied", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		p := run.Command("bash", "-c", "ulimit -Sn; ulimit -Hn")
+		p.Limits = map[run.Resource]run.Rlimit{run.RlimitNoFile: {Cur: 64, Max: 128}}
+		buf := &bytes.Buffer{}
+		p.Stdout = buf
+		is.NoErr(p.Run(t.Context()))
+		is.Equal(buf.String(), "64\n128\n")
+	})
+
+	t.Run("setuid", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		// tracing would drop the setuid bit so the limits are set once it has started instead
+		sleep := filepath.Join(t.TempDir(), "sleep")
+		b, err := os.ReadFile("/bin/sleep")
+		is.NoErr(err)
+		is.NoErr(os.WriteFile(sleep, b, 0o755))
+		is.NoErr(os.Chmod(sleep, 0o4755))
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		p := run.Command(sleep, "60")
+		p.Limits = map[run.Resource]run.Rlimit{run.RlimitNoFile: {Cur: 64, Max: 128}}
+		var limits []byte
+		p.OnStart = func(h *run.Handle) {
+			limits, _ = os.ReadFile(fmt.Sprintf("/proc/%d/limits", h.Pid))
+			cancel()
+		}
+		_ = p.Run(ctx)
+		is.True(regexp.MustCompile(`Max open files\s+64\s+128`).Match(limits))
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		p := run.Command("bash", "-c", "while :; do :; done")
+		p.Limits = map[run.Resource]run.Rlimit{run.RlimitCPU: {Cur: 1, Max: 2}}
+		err := p.Run(t.Context())
+		var perr *run.ProcessError
+		is.True(errors.As(err, &perr))
+		is.Equal(perr.Signal, syscall.SIGXCPU)
+		is.True(perr.LimitExceeded)
+		is.Equal(perr.Limit, run.RlimitCPU)
+		is.True(strings.HasSuffix(err.Error(), "RLIMIT_CPU exceeded"))
+	})
+}
+
+func TestProcessCgroup(t *testing.T) {
+	t.Parallel()
+
+	t.Run("fallback", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		p := run.Command("true")
+		p.Cgroup = &run.Cgroup{Parent: t.TempDir()}
+		is.NoErr(p.Run(t.Context()))
+		_, err := p.Cgroup.Usage()
+		is.True(err != nil) // not a cgroup
+
+		p.Cgroup.Required = true
+		is.True(p.Run(t.Context()) != nil)
+	})
+
+	t.Run("kill and account", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		p := run.Command("bash", "-c", "setsid sleep 60 >/dev/null 2>&1 & echo $!; for ((i=0; i<100000; i++)); do :; done")
+		p.Cgroup = &run.Cgroup{Required: true}
+		buf := &bytes.Buffer{}
+		p.Stdout = buf
+		err := p.Run(t.Context())
+		if err != nil {
+			t.Skip("cgroup v2 not delegated:", err)
+		}
+		daemon, err := strconv.Atoi(strings.TrimSpace(buf.String()))
+		is.NoErr(err)
+		is.True(!running(daemon)) // killed with the cgroup
+
+		usage, err := p.Cgroup.Usage()
+		is.NoErr(err)
+		is.True(usage.CPU > 0)
+	})
+}
+
+func TestProcessTTY(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	p := run.Command("bash", "-c", "[ -t 0 ] && [ -t 1 ] && [ -t 2 ] && stty size; read -r line; echo \"got $line\"")
+	p.TTY = &run.TTY{Rows: 30, Cols: 100}
+	p.Stdin = strings.NewReader("hello\n")
+	buf := &bytes.Buffer{}
+	p.Stdout = buf
+	is.NoErr(p.Run(t.Context()))
+	// the terminal translates newlines and echoes input whenever it's written
+	is.True(strings.Contains(buf.String(), "30 100\r\n"))
+	is.True(strings.HasSuffix(buf.String(), "got hello\r\n"))
+
+	t.Run("background", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		// the background process keeps the terminal open after the process exits, ignoring the SIGHUP sent
+		// when the terminal's session leader exits
+		p := run.Command("bash", "-c", "trap '' HUP; sleep 60 & echo $!")
+		p.TTY = &run.TTY{}
+		buf := &bytes.Buffer{}
+		p.Stdout = buf
+		start := time.Now()
+		is.NoErr(p.Run(t.Context()))
+		is.True(time.Since(start) < 5*time.Second)
+		pid, err := strconv.Atoi(strings.TrimSpace(buf.String()))
+		is.NoErr(err)
+		is.True(running(pid))
+		is.NoErr(syscall.Kill(pid, syscall.SIGKILL))
+	})
+}
+
+// startReady runs p in the background returning the first line p writes to stdout once it has been written.
+func startReady(t *testing.T, ctx context.Context, p run.Process) (string, <-chan error) {
+	t.Helper()
+	r, w := io.Pipe()
+	p.Stdout = w
+	res := make(chan error, 1)
+	run.Go(ctx, p, res)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, r)
+	return strings.TrimSpace(line), res
+}
+
+// running reports whether pid is running and not a zombie waiting to be reaped.
+func running(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	_, after, _ := bytes.Cut(stat, []byte(") "))
+	return len(after) > 0 && after[0] != 'Z'
+}
@@ -0,0 +1,162 @@
+package run
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// time to wait for output to be copied once the process has exited before closing the terminal, processes
+// it started in the background may keep it open
+const ttyCloseWait = time.Second
+
+// TTY attaches a [Process] to a pseudo-terminal so the process behaves as if it were run interactively,
+// keeping colours and line buffered output.
+//
+// A terminal combines output so everything the process writes is copied to Stdout, Stderr is unused.
+// Input from Stdin is echoed back by the terminal as it would be when typed.
+//
+// A TTY may be shared between runs but only attached to one running process at a time.
+type TTY struct {
+	// initial size of the terminal, defaults to 24 rows of 80 columns.
+	Rows uint16
+	Cols uint16
+	// keep the terminal the same size as the terminal this program's stdin is attached to,
+	// resizing it whenever this program receives a SIGWINCH.
+	FollowSize bool
+
+	mu     sync.Mutex
+	master *os.File
+}
+
+// Resize sets the size of the terminal signalling the attached process with SIGWINCH.
+//
+// If no process is attached the size is used the next time one is.
+func (t *TTY) Resize(rows, cols uint16) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Rows, t.Cols = rows, cols
+	if t.master == nil {
+		return nil
+	}
+	return setWinsize(t.master, winsize{Row: rows, Col: cols})
+}
+
+// winsize is struct winsize from ioctl_tty(2).
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// tty is a pseudo-terminal attached to a single run of a process.
+type tty struct {
+	t      *TTY
+	master *os.File
+	slave  *os.File
+	stdin  io.Reader
+	stdout io.Writer
+	copied chan struct{}
+	winch  chan os.Signal
+	// whether the process started and output is being copied
+	running bool
+}
+
+// attach configures cmd to run in a new session with a pseudo-terminal as its controlling terminal.
+func (t *TTY) attach(cmd *exec.Cmd) (*tty, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.master != nil {
+		_, _ = master.Close(), slave.Close()
+		return nil, errors.New("run: TTY already attached to a running process")
+	}
+	size := winsize{Row: t.Rows, Col: t.Cols}
+	if size.Row == 0 || size.Col == 0 {
+		size = winsize{Row: 24, Col: 80}
+	}
+	if t.FollowSize {
+		if curr, err := getWinsize(os.Stdin); err == nil {
+			size = curr
+		}
+	}
+	if err := setWinsize(master, size); err != nil {
+		_, _ = master.Close(), slave.Close()
+		return nil, err
+	}
+	t.master = master
+
+	pt := &tty{t: t, master: master, slave: slave, stdin: cmd.Stdin, stdout: cmd.Stdout, copied: make(chan struct{})}
+	if pt.stdout == nil {
+		pt.stdout = io.Discard
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	// a session leader is also the leader of a new process group so the process can still be
+	// signalled through its group
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	return pt, nil
+}
+
+// start starts copying input and output once the process has started.
+func (pt *tty) start() {
+	pt.running = true
+	// the process has its own copy of slave, output ends once every copy is closed
+	_ = pt.slave.Close()
+	go func() {
+		defer close(pt.copied)
+		_, _ = io.Copy(pt.stdout, pt.master)
+	}()
+	if pt.stdin != nil {
+		// like os/exec a Stdin that never returns leaks this goroutine until the next Write fails
+		go func() { _, _ = io.Copy(pt.master, pt.stdin) }()
+	}
+	if pt.t.FollowSize {
+		pt.winch = make(chan os.Signal, 1)
+		signal.Notify(pt.winch, syscall.SIGWINCH)
+		go func() {
+			for range pt.winch {
+				if size, err := getWinsize(os.Stdin); err == nil {
+					// the kernel signals the foreground process group of the terminal with SIGWINCH
+					_ = pt.t.Resize(size.Row, size.Col)
+				}
+			}
+		}()
+	}
+}
+
+// close waits up to ttyCloseWait for remaining output to be copied and detaches the terminal.
+func (pt *tty) close() {
+	if pt.winch != nil {
+		signal.Stop(pt.winch)
+		close(pt.winch)
+	}
+	if pt.running {
+		select {
+		case <-pt.copied:
+		case <-time.After(ttyCloseWait):
+		}
+	} else {
+		_ = pt.slave.Close()
+	}
+	pt.t.mu.Lock()
+	pt.t.master = nil
+	pt.t.mu.Unlock()
+	// closing master stops the copy if a process still has the terminal open
+	_ = pt.master.Close()
+	if pt.running {
+		<-pt.copied
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package run
+
+import (
+	"errors"
+	"os"
+)
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.ErrUnsupported
+}
+
+func getWinsize(_ *os.File) (winsize, error) {
+	return winsize{}, errors.ErrUnsupported
+}
+
+func setWinsize(_ *os.File, _ winsize) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,158 @@
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sampler samples the resource usage of a [Process] from /proc while it runs.
+//
+// A Sampler may be shared between runs, the usage it reports is reset each time a process starts.
+type Sampler struct {
+	// time between samples, defaults to 100ms.
+	Interval time.Duration
+	// include every descendant and member of the process group of the process in samples.
+	Descendants bool
+	// called with every sample.
+	OnSample func(Usage)
+
+	mu   sync.Mutex
+	last Usage
+	peak Usage
+}
+
+// Usage is the resource usage of a process, or a process and its descendants, sampled from /proc.
+type Usage struct {
+	// time the sample was taken
+	Time time.Time
+	// number of processes sampled
+	Processes int
+	// resident set size in bytes
+	RSS uint64
+	// user and system CPU time consumed so far
+	CPU time.Duration
+	// number of open file descriptors
+	FDs int
+	// number of threads
+	Threads int
+	// bytes read from and written to storage so far
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// clockTicks is the number of clock ticks per second /proc/<pid>/stat reports CPU time in,
+// which is USER_HZ and fixed at 100 for every Linux architecture.
+const clockTicks = 100
+
+// Last returns the most recent sample.
+func (s *Sampler) Last() Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Peak returns the largest value of each field seen across samples, Time is the time of the last sample.
+func (s *Sampler) Peak() Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// run samples pid until done is closed.
+func (s *Sampler) run(pid int, done <-chan struct{}) {
+	s.mu.Lock()
+	s.last, s.peak = Usage{}, Usage{}
+	s.mu.Unlock()
+
+	tick := time.NewTicker(cmp.Or(s.Interval, 100*time.Millisecond))
+	defer tick.Stop()
+	for {
+		if u, ok := s.sample(pid); ok {
+			s.record(u)
+		}
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (s *Sampler) record(u Usage) {
+	s.mu.Lock()
+	s.last = u
+	s.peak = Usage{
+		Time:       u.Time,
+		Processes:  max(s.peak.Processes, u.Processes),
+		RSS:        max(s.peak.RSS, u.RSS),
+		CPU:        max(s.peak.CPU, u.CPU),
+		FDs:        max(s.peak.FDs, u.FDs),
+		Threads:    max(s.peak.Threads, u.Threads),
+		ReadBytes:  max(s.peak.ReadBytes, u.ReadBytes),
+		WriteBytes: max(s.peak.WriteBytes, u.WriteBytes),
+	}
+	s.mu.Unlock()
+	if s.OnSample != nil {
+		s.OnSample(u)
+	}
+}
+
+// sample reads the usage of pid, ok is false if the process has exited.
+func (s *Sampler) sample(pid int) (u Usage, ok bool) {
+	var procs []proc
+	if s.Descendants {
+		procs, _ = processTree(pid)
+	} else if p, err := readProc(pid); err == nil {
+		procs = []proc{p}
+	}
+
+	u.Time = time.Now()
+	for _, p := range procs {
+		if p.State == 'Z' {
+			continue
+		}
+		dir := "/proc/" + strconv.Itoa(p.Pid) + "/"
+		u.Processes++
+		u.CPU += time.Duration(p.Utime+p.Stime) * time.Second / clockTicks
+		u.Threads += p.Threads
+		if status, err := readKeyedFile(dir+"status", ':'); err == nil {
+			// reported in kB
+			u.RSS += status["VmRSS"] * 1024
+		}
+		// io requires the same permissions as ptrace so may be unavailable
+		if io, err := readKeyedFile(dir+"io", ':'); err == nil {
+			u.ReadBytes += io["read_bytes"]
+			u.WriteBytes += io["write_bytes"]
+		}
+		if fds, err := os.ReadDir(dir + "fd"); err == nil {
+			u.FDs += len(fds)
+		}
+	}
+	return u, u.Processes > 0
+}
+
+// readKeyedFile reads a file of "key<sep> value [unit]" lines keeping the values that are integers.
+func readKeyedFile(fn string, sep byte) (map[string]uint64, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		key, value, _ := bytes.Cut(s.Bytes(), []byte{sep})
+		fields := bytes.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		if n, err := strconv.ParseUint(string(fields[0]), 10, 64); err == nil {
+			values[string(key)] = n
+		}
+	}
+	return values, s.Err()
+}
@@ -0,0 +1,38 @@
+package run_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestSampler(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	var samples atomic.Int64
+	s := &run.Sampler{
+		Interval:    10 * time.Millisecond,
+		Descendants: true,
+		OnSample:    func(run.Usage) { samples.Add(1) },
+	}
+	// hold 32MiB in a child of the process
+	p := run.Command("bash", "-c", `bash -c 'x=$(head -c 33554432 /dev/zero | tr "\0" a); sleep 0.3; exit 1'`)
+	p.Sampler = s
+	err := p.Run(t.Context())
+
+	var perr *run.ProcessError
+	is.True(errors.As(err, &perr))
+	is.True(perr.Usage != nil)
+	is.Equal(*perr.Usage, s.Peak())
+	is.True(samples.Load() > 1)
+	peak := s.Peak()
+	is.True(peak.RSS > 32<<20)
+	is.True(peak.Processes >= 2)
+	is.True(peak.Threads >= 2)
+	is.True(peak.FDs >= 3)
+	is.True(peak.CPU > 0)
+}
@@ -0,0 +1,47 @@
+package run
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+)
+
+// ForwardSignals returns a [Runner] forwarding sigs received by this program to the process group of every
+// [Process] run by r, as if each had them in [Process.ForwardSignals].
+func ForwardSignals(r Runner, sigs ...os.Signal) Runner {
+	return Func(func(ctx context.Context) error {
+		inherited, _ := ctx.Value(signalsKey{}).([]os.Signal)
+		sigs := append(slices.Clip(inherited), sigs...)
+		return r.Run(context.WithValue(ctx, signalsKey{}, sigs))
+	})
+}
+
+type signalsKey struct{}
+
+// notifySignals returns a channel receiving the signals p forwards, which must be stopped with
+// [signal.Stop].
+func (p Process) notifySignals(ctx context.Context) chan os.Signal {
+	sigs, _ := ctx.Value(signalsKey{}).([]os.Signal)
+	sigs = append(slices.Clip(sigs), p.ForwardSignals...)
+	c := make(chan os.Signal, 1)
+	if len(sigs) > 0 {
+		signal.Notify(c, sigs...)
+	}
+	return c
+}
+
+// forwardSignals sends signals received from c to the process group pid until done is closed.
+func forwardSignals(pid int, c <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-c:
+			if sig, ok := sig.(syscall.Signal); ok {
+				_ = syscall.Kill(-pid, sig)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package run_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+// trapScript prints ready then exits after printing the name of the first trapped signal.
+const trapScript = `trap 'echo USR1; exit 0' USR1; trap 'echo USR2; exit 0' USR2; echo ready; while true; do sleep 0.05; done`
+
+// not parallel as signals are sent to the test binary itself
+func TestForwardSignals(t *testing.T) {
+	t.Run("process", func(t *testing.T) {
+		is := is.New(t)
+		p := run.Command("bash", "-c", trapScript)
+		p.ForwardSignals = []os.Signal{syscall.SIGUSR1}
+		r, w := io.Pipe()
+		p.Stdout = w
+		res := make(chan error, 1)
+		run.Go(t.Context(), p, res)
+		lines := bufio.NewScanner(r)
+		is.True(lines.Scan())
+		is.Equal(lines.Text(), "ready")
+
+		is.NoErr(syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+		is.True(lines.Scan())
+		is.Equal(lines.Text(), "USR1")
+		go io.Copy(io.Discard, r)
+		select {
+		case err := <-res:
+			is.NoErr(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("process did not exit")
+		}
+	})
+
+	t.Run("group", func(t *testing.T) {
+		is := is.New(t)
+		group := run.Group{}
+		var outputs []*bufio.Scanner
+		for _, name := range []string{"a", "b"} {
+			// keeps running after the signal so the group doesn't stop the other process before it is
+			// forwarded the signal too
+			p := run.Command("bash", "-c", `trap 'echo USR2' USR2; echo ready; while true; do sleep 0.05; done`)
+			p.Name = name
+			r, w := io.Pipe()
+			p.Stdout = w
+			group[name] = p
+			outputs = append(outputs, bufio.NewScanner(r))
+		}
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		res := make(chan error, 1)
+		run.Go(ctx, run.ForwardSignals(group, syscall.SIGUSR2), res)
+		for _, lines := range outputs {
+			is.True(lines.Scan())
+			is.Equal(lines.Text(), "ready")
+		}
+
+		is.NoErr(syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+		for _, lines := range outputs {
+			is.True(lines.Scan())
+			is.Equal(lines.Text(), "USR2")
+		}
+		cancel()
+		select {
+		case err := <-res:
+			is.NoErr(err) // stopped by cancelling
+		case <-time.After(5 * time.Second):
+			t.Fatal("group did not exit")
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// SubprocessEnv is the environment variable [Subprocess] uses to tell the re-executed binary which
+// registered function to run.
+const SubprocessEnv = "RUN_SUBPROCESS"
+
+var (
+	subprocessesMu sync.Mutex
+	subprocesses   = map[string]func(ctx context.Context, args []string) error{}
+)
+
+// RegisterSubprocess registers fn to be run in a child process started by [Subprocess] with name.
+//
+// Functions should be registered from init or before [RunSubprocess] is called and names must be unique.
+func RegisterSubprocess(name string, fn func(ctx context.Context, args []string) error) {
+	subprocessesMu.Lock()
+	defer subprocessesMu.Unlock()
+	if _, exists := subprocesses[name]; exists {
+		panic(fmt.Sprintf("run: subprocess %q already registered", name))
+	}
+	subprocesses[name] = fn
+}
+
+// Subprocess returns a [Process] that re-executes the current binary to run the function registered
+// with [RegisterSubprocess] as name with args.
+//
+// The binary must call [RunSubprocess] before doing anything else such as at the start of main or TestMain.
+func Subprocess(name string, args ...string) Process {
+	exe, err := os.Executable()
+	if err != nil {
+		// LookPath fails on an empty path when the process is run
+		exe = ""
+	}
+	return Process{
+		Name:         name,
+		Path:         exe,
+		Args:         args,
+		Env:          map[string]string{SubprocessEnv: name},
+		InheritOSEnv: true,
+	}
+}
+
+// RunSubprocess runs the registered function and exits if this program was started by [Subprocess],
+// otherwise it returns immediately.
+//
+// The function's context is cancelled when the process receives a SIGINT or SIGTERM. The program exits
+// with status 0 if the function returns nil, otherwise the error is printed to stderr and the program exits
+// with status 1, or the status returned by the error's ExitCode method if it has one.
+func RunSubprocess() {
+	name, ok := os.LookupEnv(SubprocessEnv)
+	if !ok {
+		return
+	}
+	// processes started by the function are not subprocesses themselves
+	_ = os.Unsetenv(SubprocessEnv)
+
+	subprocessesMu.Lock()
+	fn := subprocesses[name]
+	subprocessesMu.Unlock()
+	if fn == nil {
+		fmt.Fprintf(os.Stderr, "run: subprocess %q not registered\n", name)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err := fn(ctx, os.Args[1:])
+	stop()
+	if err == nil {
+		os.Exit(0)
+	}
+	fmt.Fprintf(os.Stderr, "run: subprocess %s: %v\n", name, err)
+	var coder interface{ ExitCode() int }
+	if errors.As(err, &coder) {
+		os.Exit(coder.ExitCode())
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,67 @@
+package run_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+type exitCode int
+
+func (e exitCode) Error() string { return fmt.Sprintf("exit code %d", e) }
+func (e exitCode) ExitCode() int { return int(e) }
+
+func init() {
+	run.RegisterSubprocess("echo", func(_ context.Context, args []string) error {
+		_, inherited := os.LookupEnv(run.SubprocessEnv)
+		fmt.Println(strings.Join(args, " "), inherited)
+		return nil
+	})
+	run.RegisterSubprocess("daemon", func(ctx context.Context, _ []string) error {
+		fmt.Println("ready")
+		<-ctx.Done()
+		fmt.Println("graceful")
+		return exitCode(3)
+	})
+}
+
+func TestSubprocess(t *testing.T) {
+	t.Parallel()
+
+	t.Run("args", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		p := run.Subprocess("echo", "Hello,", "World!")
+		buf := &bytes.Buffer{}
+		p.Stdout = buf
+		is.NoErr(p.Run(t.Context()))
+		is.Equal(buf.String(), "Hello, World! false\n")
+	})
+
+	t.Run("signals", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		ctx, cancel := context.WithCancel(t.Context())
+		line, res := startReady(t, ctx, run.Subprocess("daemon"))
+		is.Equal(line, "ready")
+		cancel()
+		err := <-res
+		var perr *run.ProcessError
+		is.True(errors.As(err, &perr))
+		is.Equal(perr.Err.Error(), "exit status 3")
+	})
+
+	t.Run("not registered", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		err := run.Subprocess("nope").Run(t.Context())
+		is.Equal(err.Error(), "run.Process[nope]: exit status 2")
+	})
+}
@@ -0,0 +1,182 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Tail returns a [Runner] that keeps the last n lines of output of every [Process] run by r in memory.
+//
+// If r returns an error, including [ErrTimeout] from a [Group] whose members didn't exit, the output of
+// every process is written to w. If w is nil the output is attached to the returned error as a [*TailError]
+// instead.
+func Tail(r Runner, n int, w io.Writer) Runner {
+	return Func(func(ctx context.Context) error {
+		t := &tails{lines: n}
+		err := r.Run(context.WithValue(ctx, tailsKey{}, t))
+		if err == nil {
+			return nil
+		}
+		terr := &TailError{Err: err, Output: t.output()}
+		if w == nil {
+			return terr
+		}
+		_, _ = io.WriteString(w, terr.dump())
+		return err
+	})
+}
+
+// TailError is returned by a [Tail] runner when the runner fails.
+type TailError struct {
+	Err error
+	// last lines of output of each process in the order they started
+	Output []ProcessOutput
+}
+
+// ProcessOutput is the last lines of output of a [Process].
+type ProcessOutput struct {
+	Name  string
+	Lines []string
+}
+
+func (e *TailError) Error() string {
+	return e.Err.Error() + "\n" + e.dump()
+}
+
+func (e *TailError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TailError) dump() string {
+	var b strings.Builder
+	for _, o := range e.Output {
+		fmt.Fprintf(&b, "--- output of %s (last %d lines) ---\n", o.Name, len(o.Lines))
+		for _, line := range o.Lines {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+type tailsKey struct{}
+
+// tails collects the rings of every process run with a context from [Tail].
+type tails struct {
+	lines int
+	mu    sync.Mutex
+	rings []*ring
+}
+
+func (t *tails) add(r *ring) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rings = append(t.rings, r)
+}
+
+func (t *tails) output() []ProcessOutput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]ProcessOutput, len(t.rings))
+	for i, r := range t.rings {
+		out[i] = ProcessOutput{Name: r.name, Lines: r.lines()}
+	}
+	return out
+}
+
+// newRing returns the ring output of p should be recorded in or nil if output isn't kept.
+func (p Process) newRing(ctx context.Context) *ring {
+	n := p.TailLines
+	t, _ := ctx.Value(tailsKey{}).(*tails)
+	if t != nil {
+		n = max(n, t.lines)
+	}
+	if n <= 0 {
+		return nil
+	}
+	r := &ring{name: p.Name, buf: make([]string, n)}
+	if t != nil {
+		t.add(r)
+	}
+	return r
+}
+
+// ring keeps the last len(buf) lines written to it.
+type ring struct {
+	name string
+	mu   sync.Mutex
+	buf  []string
+	// index the next line is written to and whether buf has wrapped
+	next    int
+	wrapped bool
+	// lines not yet terminated by a newline from each writer
+	partials []*partialLine
+}
+
+func (r *ring) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = line
+	r.next = (r.next + 1) % len(r.buf)
+	r.wrapped = r.wrapped || r.next == 0
+}
+
+func (r *ring) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.wrapped {
+		return append([]string(nil), r.buf[:r.next]...)
+	}
+	return append(append([]string(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// writer returns a writer adding each line written to r, and writing to w if w is not nil.
+//
+// Each writer buffers its own partial line so stdout and stderr can be recorded in the same ring.
+func (r *ring) writer(w io.Writer) io.Writer {
+	pw := &partialLine{}
+	r.mu.Lock()
+	r.partials = append(r.partials, pw)
+	r.mu.Unlock()
+	return writerFunc(func(b []byte) (int, error) {
+		pw.mu.Lock()
+		pw.buf = append(pw.buf, b...)
+		for {
+			i := bytes.IndexByte(pw.buf, '\n')
+			if i < 0 {
+				break
+			}
+			r.add(string(bytes.TrimSuffix(pw.buf[:i], []byte{'\r'})))
+			pw.buf = pw.buf[i+1:]
+		}
+		pw.mu.Unlock()
+		if w != nil {
+			return w.Write(b)
+		}
+		return len(b), nil
+	})
+}
+
+// flush adds the partial lines of every writer once writing has finished.
+func (r *ring) flush() {
+	r.mu.Lock()
+	partials := r.partials
+	r.mu.Unlock()
+	for _, pw := range partials {
+		pw.mu.Lock()
+		if len(pw.buf) > 0 {
+			r.add(string(pw.buf))
+			pw.buf = nil
+		}
+		pw.mu.Unlock()
+	}
+}
+
+type partialLine struct {
+	mu  sync.Mutex
+	buf []byte
+}
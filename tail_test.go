@@ -0,0 +1,73 @@
+package run_test
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matgreaves/run"
+	"github.com/matryer/is"
+)
+
+func TestTail(t *testing.T) {
+	t.Parallel()
+
+	t.Run("process error", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		p := run.Command("bash", "-c", "for i in 1 2 3 4 5; do echo $i; done; printf 'oops' >&2; exit 3")
+		p.TailLines = 3
+		err := p.Run(t.Context())
+		var perr *run.ProcessError
+		is.True(errors.As(err, &perr))
+		is.Equal(perr.Output, []string{"4", "5", "oops"})
+	})
+
+	t.Run("daemon", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		// the daemon keeps the pipe output is copied through open after the process exits
+		p := run.Command("bash", "-c", "sleep 60 & echo $!")
+		p.TailLines = 3
+		p.StopTimeout = 100 * time.Millisecond
+		buf := &bytes.Buffer{}
+		p.Stdout = buf
+		start := time.Now()
+		is.NoErr(p.Run(t.Context()))
+		is.True(time.Since(start) < 5*time.Second)
+		pid, err := strconv.Atoi(strings.TrimSpace(buf.String()))
+		is.NoErr(err)
+		is.NoErr(syscall.Kill(pid, syscall.SIGKILL))
+	})
+
+	t.Run("dump", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		a := run.Command("bash", "-c", "echo started; sleep 60")
+		a.Name = "a"
+		b := run.Command("bash", "-c", "sleep 0.2; echo failing; exit 1")
+		b.Name = "b"
+		buf := &bytes.Buffer{}
+		err := run.Tail(run.Group{"a": a, "b": b}, 10, buf).Run(t.Context())
+		is.True(err != nil)
+		var terr *run.TailError
+		is.True(!errors.As(err, &terr)) // written to buf instead
+		is.True(strings.Contains(buf.String(), "--- output of a (last 1 lines) ---\nstarted\n"))
+		is.True(strings.Contains(buf.String(), "--- output of b (last 1 lines) ---\nfailing\n"))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+		is := is.New(t)
+		err := run.Tail(run.Command("bash", "-c", "echo failing; exit 1"), 10, nil).Run(t.Context())
+		var terr *run.TailError
+		is.True(errors.As(err, &terr))
+		is.Equal(terr.Output, []run.ProcessOutput{{Name: "bash", Lines: []string{"failing"}}})
+		var perr *run.ProcessError
+		is.True(errors.As(err, &perr))
+	})
+}
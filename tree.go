@@ -0,0 +1,106 @@
+package run
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"github.com/matgreaves/run/internal/procfs"
+)
+
+// proc is a process as observed through /proc/<pid>/stat.
+type proc struct {
+	procfs.Stat
+}
+
+// readProc reads the stat of the process pid.
+func readProc(pid int) (proc, error) {
+	s, err := procfs.Read(pid)
+	return proc{s}, err
+}
+
+// listProcs returns every process visible in /proc.
+func listProcs() ([]proc, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]proc, 0, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// processes can exit between listing and reading
+		p, err := readProc(pid)
+		if err != nil {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// processTree returns root, every descendant of root and every member of the process group led by
+// root, ordered so that descendants always come before their ancestors.
+//
+// Descendants are found by following parent links so processes that moved into another session or
+// process group are still found as long as their parent is alive. Descendants reparented to init or a
+// subreaper after their parent exited are only found if they stayed in the process group.
+func processTree(root int) ([]proc, error) {
+	procs, err := listProcs()
+	if err != nil {
+		return nil, err
+	}
+	children := map[int][]proc{}
+	for _, p := range procs {
+		children[p.Ppid] = append(children[p.Ppid], p)
+	}
+
+	depth := map[int]int{}
+	var tree []proc
+	var walk func(p proc, d int)
+	walk = func(p proc, d int) {
+		if _, seen := depth[p.Pid]; seen {
+			return
+		}
+		depth[p.Pid] = d
+		tree = append(tree, p)
+		for _, c := range children[p.Pid] {
+			walk(c, d+1)
+		}
+	}
+	for _, p := range procs {
+		if p.Pid == root {
+			walk(p, 0)
+		}
+	}
+	// group members whose parent already exited have been reparented away from the tree
+	for _, p := range procs {
+		if p.Pgid == root {
+			walk(p, 1)
+		}
+	}
+
+	slices.SortStableFunc(tree, func(a, b proc) int { return depth[b.Pid] - depth[a.Pid] })
+	return tree, nil
+}
+
+// alive reports whether p is still running and has not been replaced by a process reusing its pid.
+func (p proc) alive() bool {
+	curr, err := readProc(p.Pid)
+	if err != nil {
+		return false
+	}
+	return curr.Start == p.Start && curr.State != 'Z'
+}
+
+// signalTree sends sig to every process in tree in order.
+func signalTree(tree []proc, sig syscall.Signal) {
+	for _, p := range tree {
+		if p.alive() {
+			_ = syscall.Kill(p.Pid, sig)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package run
+
+import (
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestProcessTree(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	tree, err := processTree(os.Getpid())
+	is.NoErr(err)
+	is.True(len(tree) > 0)
+	is.Equal(tree[len(tree)-1].Pid, os.Getpid()) // root is signalled last
+}